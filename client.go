@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/luyuhuang/subsocks/client"
@@ -14,12 +16,34 @@ import (
 	"github.com/pelletier/go-toml"
 )
 
+type serverConfig struct {
+	Group    string `toml:"group"`
+	Protocol string `toml:"protocol"`
+	Addr     string `toml:"address"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	HTTP     struct {
+		Path string `toml:"path" default:"/"`
+	} `toml:"http"`
+	WS struct {
+		Path string `toml:"path" default:"/"`
+	} `toml:"ws"`
+	TLS struct {
+		SkipVerify bool   `toml:"skip_verify"`
+		CA         string `toml:"ca"`
+	} `toml:"tls"`
+}
+
 func launchClient(t *toml.Tree) {
 	config := struct {
-		Listen   string `toml:"listen" default:"127.0.0.1:1080"`
-		Username string `toml:"username"`
-		Password string `toml:"password"`
-		Server   struct {
+		Listen      string `toml:"listen" default:"127.0.0.1:1080"`
+		Transparent string `toml:"transparent"`
+		Metrics     string `toml:"metrics"`
+		Admin       string `toml:"admin"`
+		AdminToken  string `toml:"admin_token"`
+		Username    string `toml:"username"`
+		Password    string `toml:"password"`
+		Server      struct {
 			Protocol string `toml:"protocol"`
 			Addr     string `toml:"address"`
 		} `toml:"server"`
@@ -33,19 +57,172 @@ func launchClient(t *toml.Tree) {
 			SkipVerify bool   `toml:"skip_verify"`
 			CA         string `toml:"ca"`
 		} `toml:"tls"`
+		Servers     []serverConfig `toml:"servers"`
+		Policy      string         `toml:"policy" default:"failover"`
+		HealthCheck struct {
+			Interval int `toml:"interval" default:"30"`
+			Timeout  int `toml:"timeout" default:"5"`
+		} `toml:"health_check"`
+		Dial struct {
+			Timeout       int `toml:"timeout" default:"10"`
+			ServerTimeout int `toml:"server_timeout" default:"10"`
+		} `toml:"dial"`
+		Auto struct {
+			Delay int `toml:"delay" default:"300"`
+		} `toml:"auto"`
+		ProxyCache struct {
+			Path    string `toml:"path"`
+			TTL     int    `toml:"ttl" default:"86400"`
+			Recheck int    `toml:"recheck" default:"600"`
+		} `toml:"proxy_cache"`
+		RuleProviders []struct {
+			Path   string `toml:"path"`
+			Format string `toml:"format"`
+			Rule   string `toml:"rule"`
+		} `toml:"rule_providers"`
+		GeoIP struct {
+			Database string `toml:"database"`
+			Resolve  bool   `toml:"resolve"`
+		} `toml:"geoip"`
+		Mux struct {
+			Enable            bool `toml:"enable"`
+			MaxStreams        int  `toml:"max_streams" default:"128"`
+			KeepAliveInterval int  `toml:"keepalive_interval" default:"30"`
+			KeepAliveTimeout  int  `toml:"keepalive_timeout" default:"90"`
+		} `toml:"mux"`
+		Sniff struct {
+			Enable   bool `toml:"enable"`
+			Override bool `toml:"override"`
+		} `toml:"sniff"`
+		Forward []struct {
+			Network string `toml:"network" default:"tcp"`
+			Listen  string `toml:"listen"`
+			Target  string `toml:"target"`
+			Group   string `toml:"group"`
+		} `toml:"forward"`
+		Reverse []struct {
+			Port   int    `toml:"port"`
+			Target string `toml:"target"`
+			Group  string `toml:"group"`
+		} `toml:"reverse"`
+		DNS struct {
+			Listen string `toml:"listen"`
+			Remote string `toml:"remote"`
+			Local  string `toml:"local"`
+			FakeIP string `toml:"fake_ip"`
+		} `toml:"dns"`
 	}{}
 
 	if err := t.Unmarshal(&config); err != nil {
 		log.Fatalf("Parse '[client]' configuration failed: %s", err)
 	}
 
+	servers := config.Servers
+	if len(servers) == 0 {
+		s := serverConfig{
+			Protocol: config.Server.Protocol,
+			Addr:     config.Server.Addr,
+		}
+		s.HTTP = config.HTTP
+		s.WS = config.WS
+		s.TLS = config.TLS
+		servers = append(servers, s)
+	}
+
+	switch config.Policy {
+	case client.PolicyFailover, client.PolicyRoundRobin, client.PolicyLatency:
+	default:
+		log.Fatalf("Policy got %q, want failover|round-robin|latency", config.Policy)
+	}
+
 	cli := client.NewClient(config.Listen)
-	cli.Config.Username = config.Username
-	cli.Config.Password = config.Password
-	cli.Config.ServerProtocol = config.Server.Protocol
-	cli.Config.ServerAddr = config.Server.Addr
-	cli.Config.HTTPPath = config.HTTP.Path
-	cli.Config.WSPath = config.WS.Path
+	cli.Config.TransparentAddr = config.Transparent
+	cli.Config.MetricsAddr = config.Metrics
+	cli.Config.AdminAddr = config.Admin
+	cli.Config.AdminToken = config.AdminToken
+	cli.Config.Policy = config.Policy
+	cli.Config.HealthCheckInterval = time.Duration(config.HealthCheck.Interval) * time.Second
+	cli.Config.HealthCheckTimeout = time.Duration(config.HealthCheck.Timeout) * time.Second
+	cli.Config.DialTimeout = time.Duration(config.Dial.Timeout) * time.Second
+	cli.Config.ServerDialTimeout = time.Duration(config.Dial.ServerTimeout) * time.Second
+	cli.Config.AutoDelay = time.Duration(config.Auto.Delay) * time.Millisecond
+	cli.Config.ProxyCacheRecheck = time.Duration(config.ProxyCache.Recheck) * time.Second
+	cli.Config.Mux = config.Mux.Enable
+	cli.Config.MuxMaxStreams = config.Mux.MaxStreams
+	cli.Config.MuxKeepAliveInterval = time.Duration(config.Mux.KeepAliveInterval) * time.Second
+	cli.Config.MuxKeepAliveTimeout = time.Duration(config.Mux.KeepAliveTimeout) * time.Second
+	cli.Config.Sniff = config.Sniff.Enable
+	cli.Config.SniffOverride = config.Sniff.Override
+
+	var groups []string
+	for _, s := range servers {
+		if s.Group != "" && !utils.StrInSlice(s.Group, groups) {
+			switch s.Group {
+			case "proxy", "direct", "auto", "reject", "P", "D", "A", "R":
+				log.Fatalf("Group name %q is reserved", s.Group)
+			}
+			groups = append(groups, s.Group)
+		}
+
+		upstream := &client.Upstream{
+			Group:    s.Group,
+			Protocol: s.Protocol,
+			Addr:     s.Addr,
+			Username: s.Username,
+			Password: s.Password,
+			HTTPPath: s.HTTP.Path,
+			WSPath:   s.WS.Path,
+		}
+		if upstream.Username == "" && upstream.Password == "" {
+			upstream.Username = config.Username
+			upstream.Password = config.Password
+		}
+
+		if needsTLS[s.Protocol] {
+			tlsConfig, err := getClientTLSConfig(s.Addr, s.TLS.CA, s.TLS.SkipVerify)
+			if err != nil {
+				log.Fatalf("Get TLS configuration failed: %s", err)
+			}
+			upstream.TLSConfig = tlsConfig
+		}
+
+		cli.Config.Servers = append(cli.Config.Servers, upstream)
+	}
+
+	for _, f := range config.Forward {
+		cli.Config.Forwards = append(cli.Config.Forwards, &client.Forward{
+			Network: f.Network,
+			Listen:  f.Listen,
+			Target:  f.Target,
+			Group:   f.Group,
+		})
+	}
+
+	for _, r := range config.Reverse {
+		if r.Port < 0 || r.Port > 65535 {
+			log.Fatalf("Reverse port got %d, want 0-65535", r.Port)
+		}
+		cli.Config.Reverses = append(cli.Config.Reverses, &client.Reverse{
+			Port:   r.Port,
+			Target: r.Target,
+			Group:  r.Group,
+		})
+	}
+
+	if config.DNS.Listen != "" {
+		local := config.DNS.Local
+		if local == "" {
+			if local = utils.SystemDNS(); local == "" {
+				log.Fatalf("No system DNS found, 'client.dns.local' is required")
+			}
+		}
+		cli.Config.DNS = &client.DNS{
+			Listen: config.DNS.Listen,
+			Remote: config.DNS.Remote,
+			Local:  local,
+			FakeIP: config.DNS.FakeIP,
+		}
+	}
 
 	switch users := t.Get("users").(type) {
 	case string:
@@ -60,7 +237,7 @@ func launchClient(t *toml.Tree) {
 
 	switch rules := t.Get("rules").(type) {
 	case string:
-		r, err := client.NewRulesFromFile(rules)
+		r, err := client.NewRulesFromFile(rules, groups...)
 		if err != nil {
 			log.Fatalf("Load rule file failed: %s", err)
 		}
@@ -70,19 +247,46 @@ func launchClient(t *toml.Tree) {
 		if err := rules.Unmarshal(&m); err != nil {
 			log.Fatalf("Parse 'client.rules' configuration failed: %s", err)
 		}
-		r, err := client.NewRulesFromMap(m)
+		r, err := client.NewRulesFromMap(m, groups...)
 		if err != nil {
 			log.Fatalf("Load rules file failed: %s", err)
 		}
 		cli.Rules = r
 	}
 
-	if needsTLS[config.Server.Protocol] {
-		tlsConfig, err := getClientTLSConfig(config.Server.Addr, config.TLS.CA, config.TLS.SkipVerify)
+	if len(config.RuleProviders) > 0 && cli.Rules == nil {
+		// other addresses are proxied as if there were no rules
+		r, err := client.NewRulesFromMap(map[string]string{"*": "proxy"}, groups...)
 		if err != nil {
-			log.Fatalf("Get TLS configuration failed: %s", err)
+			log.Fatalf("Create rules failed: %s", err)
+		}
+		cli.Rules = r
+	}
+	for _, p := range config.RuleProviders {
+		if err := cli.Rules.AddProvider(&client.Provider{Path: p.Path, Format: p.Format, Rule: p.Rule}); err != nil {
+			log.Fatalf("Add rule provider failed: %s", err)
+		}
+	}
+
+	if cli.Rules != nil {
+		path := config.ProxyCache.Path
+		if path == "" {
+			dir, err := os.UserCacheDir()
+			if err != nil {
+				log.Fatalf("No user cache directory, 'client.proxy_cache.path' is required: %s", err)
+			}
+			path = filepath.Join(dir, "subsocks", "proxy-cache")
+		}
+		ttl := time.Duration(config.ProxyCache.TTL) * time.Second
+		if err := cli.Rules.LoadCache(path, ttl); err != nil {
+			log.Fatalf("Load proxy cache failed: %s", err)
+		}
+
+		if config.GeoIP.Database != "" {
+			if err := cli.Rules.LoadGeoIP(config.GeoIP.Database, config.GeoIP.Resolve); err != nil {
+				log.Fatalf("Load GeoIP database failed: %s", err)
+			}
 		}
-		cli.TLSConfig = tlsConfig
 	}
 
 	if err := cli.Serve(); err != nil {
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recheckConcurrency is the most direct connections a recheck makes at
+// the same time
+const recheckConcurrency = 16
+
+// cacheEntry is an address that the server won the race to
+type cacheEntry struct {
+	port     int       // of the last connection, zero if unknown
+	since    time.Time // when it's cached
+	checked  time.Time // when the direct connection failed last time
+	failures int       // times the direct connection failed
+}
+
+// autoCache remembers addresses that auto rules proxy. An entry expires if
+// its direct connection hasn't failed in ttl, zero means never.
+type autoCache struct {
+	mu      sync.RWMutex
+	path    string // empty means not saved
+	ttl     time.Duration
+	entries map[string]*cacheEntry
+}
+
+func newAutoCache() *autoCache {
+	return &autoCache{entries: make(map[string]*cacheEntry)}
+}
+
+func (c *autoCache) expired(e *cacheEntry) bool {
+	return c.ttl > 0 && time.Since(e.checked) > c.ttl
+}
+
+// load reads entries from the file, and saves entries to it afterwards.
+// Lines are "<addr> <port> <since> <checked> <failures>", or just the
+// address in the old format.
+func (c *autoCache) load(path string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.path, c.ttl = path, ttl
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	migrated := false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		e := &cacheEntry{since: now, checked: now, failures: 1}
+		if len(fields) == 5 {
+			e.port, _ = strconv.Atoi(fields[1])
+			since, _ := strconv.ParseInt(fields[2], 10, 64)
+			checked, _ := strconv.ParseInt(fields[3], 10, 64)
+			e.since, e.checked = time.Unix(since, 0), time.Unix(checked, 0)
+			e.failures, _ = strconv.Atoi(fields[4])
+		} else {
+			migrated = true
+		}
+		c.entries[fields[0]] = e
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	// entries of the old format have no port to be rechecked, save the time
+	// they're migrated at once so that they expire in ttl after all
+	if migrated {
+		return c.save()
+	}
+	return nil
+}
+
+// save rewrites the file without expired entries, c.mu must be locked
+func (c *autoCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for addr, e := range c.entries {
+		if !c.expired(e) {
+			fmt.Fprintf(w, "%s %d %d %d %d\n", addr, e.port, e.since.Unix(), e.checked.Unix(), e.failures)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *autoCache) contains(addr string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e := c.entries[addr]
+	return e != nil && !c.expired(e)
+}
+
+// add caches addr, or counts a failure if it's cached
+func (c *autoCache) add(addr string, port int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	e := c.entries[addr]
+	if e == nil || c.expired(e) {
+		e = &cacheEntry{since: now}
+		c.entries[addr] = e
+	}
+	e.port = port
+	e.checked = now
+	e.failures++
+
+	if err := c.save(); err != nil {
+		log.Printf("[auto] save proxy cache failed: %s", err)
+	}
+}
+
+// fail counts a failure of the direct connection to addr
+func (c *autoCache) fail(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.entries[addr]; e != nil {
+		e.checked = time.Now()
+		e.failures++
+		if err := c.save(); err != nil {
+			log.Printf("[auto] save proxy cache failed: %s", err)
+		}
+	}
+}
+
+// remove removes addr, it returns false if addr is not cached
+func (c *autoCache) remove(addr string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entries[addr]
+	if e == nil {
+		return false, nil
+	}
+	delete(c.entries, addr)
+	return !c.expired(e), c.save()
+}
+
+// list returns cached addresses in order
+func (c *autoCache) list() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	list := []string{}
+	for addr, e := range c.entries {
+		if !c.expired(e) {
+			list = append(list, addr)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// due returns addresses with their ports that should be rechecked. An
+// address that has failed n times is rechecked every interval * 2^(n-1),
+// at most interval * 64. Expired entries are dropped.
+func (c *autoCache) due(interval time.Duration) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var due []string
+	for addr, e := range c.entries {
+		if c.expired(e) {
+			delete(c.entries, addr)
+			continue
+		}
+		backoff := e.failures - 1
+		if backoff > 6 {
+			backoff = 6
+		} else if backoff < 0 {
+			backoff = 0
+		}
+		if e.port != 0 && time.Since(e.checked) >= interval<<uint(backoff) {
+			due = append(due, net.JoinHostPort(addr, strconv.Itoa(e.port)))
+		}
+	}
+	return due
+}
+
+// recheckProxyCache rechecks the auto-proxy cache in background
+func (c *Client) recheckProxyCache() {
+	ticker := time.NewTicker(c.Config.ProxyCacheRecheck)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.recheck()
+	}
+}
+
+// recheck dials due addresses in the auto-proxy cache directly, they go
+// directly again once their direct connections work
+func (c *Client) recheck() {
+	sem := make(chan struct{}, recheckConcurrency)
+	var wg sync.WaitGroup
+	for _, addr := range c.Rules.cache.due(c.Config.ProxyCacheRecheck) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			host, _, _ := net.SplitHostPort(addr)
+			conn, err := net.DialTimeout("tcp", addr, c.Config.DialTimeout)
+			if err != nil {
+				c.Rules.cache.fail(host)
+				return
+			}
+			conn.Close()
+			log.Printf("[auto] %s is reachable directly again", addr)
+			if _, err := c.Rules.cache.remove(host); err != nil {
+				log.Printf("[auto] save proxy cache failed: %s", err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy-cache")
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	content := "old.example.com\n" +
+		"new.example.com 443 " + strconv.FormatInt(old, 10) + " " + strconv.FormatInt(old, 10) + " 3\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Write cache failed: %s", err)
+	}
+
+	c := newAutoCache()
+	if err := c.load(path, time.Hour); err != nil {
+		t.Fatalf("Load cache failed: %s", err)
+	}
+	if !c.contains("old.example.com") {
+		t.Fatalf("Entry of the old format should be loaded")
+	}
+	if c.contains("new.example.com") {
+		t.Fatalf("Entry checked 2 hours ago should expire in 1 hour")
+	}
+	if list := strings.Join(c.list(), ","); list != "old.example.com" {
+		t.Fatalf("List got %s, want old.example.com", list)
+	}
+
+	// the entry of the old format is saved in the new format at once, so
+	// loading again doesn't renew it
+	since := c.entries["old.example.com"].since.Unix()
+	c2 := newAutoCache()
+	if err := c2.load(path, time.Hour); err != nil {
+		t.Fatalf("Load cache again failed: %s", err)
+	}
+	if e := c2.entries["old.example.com"]; e == nil || e.since.Unix() != since || e.checked.Unix() != since {
+		t.Fatalf("Migrated entry loaded again got %+v, want since %d", e, since)
+	}
+
+	// an expired entry starts over
+	c.add("new.example.com", 80)
+	e := c.entries["new.example.com"]
+	if !c.contains("new.example.com") || e.failures != 1 || e.port != 80 {
+		t.Fatalf("Entry added again got %+v", e)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 2 ||
+		!strings.Contains(string(b), "old.example.com 0 ") || !strings.Contains(string(b), "new.example.com 80 ") {
+		t.Fatalf("Saved cache got %q", b)
+	}
+}
+
+func TestAutoCacheDue(t *testing.T) {
+	c := newAutoCache()
+	c.ttl = 24 * time.Hour
+	now := time.Now()
+	c.entries = map[string]*cacheEntry{
+		"a.example.com": {port: 443, checked: now.Add(-90 * time.Second), failures: 1},
+		"b.example.com": {port: 443, checked: now.Add(-90 * time.Second), failures: 2},
+		"c.example.com": {port: 443, checked: now.Add(-5 * time.Minute), failures: 2},
+		"d.example.com": {port: 0, checked: now.Add(-5 * time.Minute), failures: 1},
+		"e.example.com": {port: 443, checked: now.Add(-25 * time.Hour), failures: 1},
+	}
+
+	due := c.due(time.Minute)
+	if len(due) != 2 || strings.Join(due, ",") != "a.example.com:443,c.example.com:443" &&
+		strings.Join(due, ",") != "c.example.com:443,a.example.com:443" {
+		t.Fatalf("Due got %v, want a.example.com:443 and c.example.com:443", due)
+	}
+	if _, ok := c.entries["e.example.com"]; ok {
+		t.Fatalf("Expired entry should be dropped")
+	}
+}
+
+func TestRecheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	closed.Close()
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.DialTimeout = time.Second
+	cli.Config.ProxyCacheRecheck = time.Millisecond
+	cli.Rules, _ = NewRulesFromMap(map[string]string{"*": "A"})
+	cli.Rules.setAsProxy("127.0.0.1", ln.Addr().(*net.TCPAddr).Port)
+	cli.Rules.setAsProxy("localhost", closed.Addr().(*net.TCPAddr).Port)
+
+	time.Sleep(2 * time.Millisecond)
+	cli.recheck()
+	if rule := cli.Rules.getRule("127.0.0.1", 0); rule != ruleAuto {
+		t.Fatalf("Rule of reachable address got %d, want %d", rule, ruleAuto)
+	}
+	if rule := cli.Rules.getRule("localhost", 0); rule != ruleProxy {
+		t.Fatalf("Rule of unreachable address got %d, want %d", rule, ruleProxy)
+	}
+	if e := cli.Rules.cache.entries["localhost"]; e.failures != 2 {
+		t.Fatalf("Failures of unreachable address got %d, want 2", e.failures)
+	}
+}
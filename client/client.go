@@ -2,20 +2,26 @@ package client
 
 import (
 	"bufio"
-	"crypto/tls"
-	"errors"
-	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
 )
 
 // Client holds contexts of the client
 type Client struct {
-	Config    *Config
-	TLSConfig *tls.Config
-	Rules     *Rules
+	Config *Config
+	Rules  *Rules
+
+	nextMu sync.Mutex
+	next   map[string]int // next server of each group for round-robin
+
+	tunnels   *tunnel.Registry
+	fakeIPs   *fakeIPPool // nil if the fake IP mode is off
+	httpConns *httpPool   // idle upstream connections of the HTTP proxy
 }
 
 // NewClient creates a client
@@ -24,11 +30,21 @@ func NewClient(addr string) *Client {
 		Config: &Config{
 			Addr: addr,
 		},
+		tunnels:   tunnel.NewRegistry(),
+		httpConns: newHTTPPool(),
 	}
 }
 
 // Serve starts the server
 func (c *Client) Serve() error {
+	if c.Config.DNS != nil && c.Config.DNS.FakeIP != "" {
+		pool, err := newFakeIPPool(c.Config.DNS.FakeIP)
+		if err != nil {
+			return err
+		}
+		c.fakeIPs = pool
+	}
+
 	laddr, err := net.ResolveTCPAddr("tcp", c.Config.Addr)
 	if err != nil {
 		return err
@@ -40,6 +56,58 @@ func (c *Client) Serve() error {
 	log.Printf("Client starts to listen socks5://%s", listener.Addr().String())
 	log.Printf("Client starts to listen http://%s", listener.Addr().String())
 
+	if c.Config.TransparentAddr != "" {
+		tl, err := net.Listen("tcp", c.Config.TransparentAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Client starts to listen transparent://%s", tl.Addr().String())
+		go c.serveTransparent(tl)
+	}
+
+	if c.Config.MetricsAddr != "" {
+		ml, err := net.Listen("tcp", c.Config.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Client starts to serve metrics at http://%s/metrics", ml.Addr().String())
+		go c.serveMetrics(ml)
+	}
+
+	if c.Config.AdminAddr != "" {
+		al, err := tunnel.ListenAdmin(c.Config.AdminAddr, c.Config.AdminToken)
+		if err != nil {
+			return err
+		}
+		log.Printf("Client starts to serve admin API at http://%s", al.Addr().String())
+		go c.serveAdmin(al)
+	}
+
+	for _, f := range c.Config.Forwards {
+		if err := c.listenForward(f); err != nil {
+			return err
+		}
+	}
+
+	if c.Config.DNS != nil {
+		if err := c.listenDNS(c.Config.DNS); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range c.Config.Reverses {
+		log.Printf("Client starts to reverse %s to %s", r, r.Target)
+		go c.serveReverse(r)
+	}
+
+	if c.Config.HealthCheckInterval > 0 {
+		go c.healthCheck()
+	}
+
+	if c.Rules != nil && c.Config.ProxyCacheRecheck > 0 {
+		go c.recheckProxyCache()
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -70,6 +138,8 @@ func probeProtocol(br *bufio.Reader) (func(*Client, net.Conn), error) {
 	switch b[0] {
 	case socks.Version:
 		return (*Client).socks5Handler, nil
+	case socks.Version4:
+		return (*Client).socks4Handler, nil
 	default:
 		return (*Client).httpHandler, nil
 	}
@@ -84,54 +154,36 @@ func (c *bufferedConn) Read(b []byte) (int, error) {
 	return c.br.Read(b)
 }
 
-var protocol2wrapper = map[string]func(*Client, net.Conn) net.Conn{
-	"https": (*Client).wrapHTTPS,
-	"http":  (*Client).wrapHTTP,
-	"socks": (*Client).wrapSocks,
-	"ws":    (*Client).wrapWS,
-	"wss":   (*Client).wrapWSS,
-}
+// Config is the client configuration
+type Config struct {
+	Addr            string
+	TransparentAddr string
+	MetricsAddr     string
+	AdminAddr       string
+	AdminToken      string
 
-func (c *Client) dialServer() (net.Conn, error) {
-	wrapper, ok := protocol2wrapper[c.Config.ServerProtocol]
-	if !ok {
-		return nil, errors.New("Unknow protocol")
-	}
+	Verify func(string, string) bool
 
-	conn, err := net.Dial("tcp", c.Config.ServerAddr)
-	if err != nil {
-		return nil, err
-	}
-	conn = wrapper(c, conn)
+	Servers             []*Upstream
+	Policy              string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
 
-	// handshake
-	if err := socks.WriteMethods([]byte{socks.MethodNoAuth}, conn); err != nil {
-		conn.Close()
-		return nil, err
-	}
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		conn.Close()
-		return nil, err
-	}
-	if buf[0] != socks.Version || buf[1] != socks.MethodNoAuth {
-		conn.Close()
-		return nil, errors.New("Handshake failed")
-	}
+	DialTimeout       time.Duration // of direct connections, zero means no timeout
+	ServerDialTimeout time.Duration // including the handshake
+	AutoDelay         time.Duration // before racing the server for auto rules
+	ProxyCacheRecheck time.Duration // zero means no recheck
 
-	return conn, nil
-}
+	Mux                  bool
+	MuxMaxStreams        int
+	MuxKeepAliveInterval time.Duration // zero means the default
+	MuxKeepAliveTimeout  time.Duration // zero means the default
 
-// Config is the client configuration
-type Config struct {
-	Addr     string
-	Username string
-	Password string
+	Sniff         bool
+	SniffOverride bool // connect the sniffed domain instead of the IP
 
-	Verify func(string, string) bool
+	Forwards []*Forward
+	Reverses []*Reverse
 
-	ServerProtocol string
-	ServerAddr     string
-	HTTPPath       string
-	WSPath         string
+	DNS *DNS
 }
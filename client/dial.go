@@ -0,0 +1,152 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/luyuhuang/subsocks/metrics"
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+var errRejected = errors.New("Rejected by rules")
+
+// replyError is returned if the server fails to connect, rep is the reply
+// code of the server
+type replyError struct {
+	rep uint8
+}
+
+func (e *replyError) Error() string {
+	return fmt.Sprintf("server connect failed: %q", &socks.Reply{Rep: e.rep})
+}
+
+// dialTarget connects to addr directly or via a server according to the
+// rules of host, and returns the rule decision. Connections via a server
+// have finished the connect request. tag and src are used for logging.
+func (c *Client) dialTarget(tag string, addr *socks.Addr, host string, src net.Addr) (nextHop net.Conn, decision string, err error) {
+	return c.dialRule(tag, addr, host, c.Rules.resolveRule(host, int(addr.Port)), src)
+}
+
+// dialRule is the same as dialTarget except that the rule of host is given
+func (c *Client) dialRule(tag string, addr *socks.Addr, host string, rule int, src net.Addr) (nextHop net.Conn, decision string, err error) {
+	switch {
+	case rule == ruleReject:
+		log.Printf(`[%s] reject %s for %s`, tag, addr, src)
+		decision, err = decisionReject, errRejected
+
+	case isProxyRule(rule):
+		log.Printf(`[%s] dial server to connect %s for %s`, tag, addr, src)
+		decision = decisionProxy
+		nextHop, err = c.dialProxied(c.Rules.groupOf(rule), addr)
+
+	case rule == ruleAuto:
+		log.Printf(`[%s] race to connect %s for %s`, tag, addr, src)
+		nextHop, decision, err = c.dialAuto(addr)
+		if err == nil && decision == decisionAutoFallback {
+			log.Printf(`[%s] server wins the race to %s for %s`, tag, addr, src)
+			c.Rules.setAsProxy(host, int(addr.Port))
+		}
+
+	default:
+		log.Printf(`[%s] dial %s for %s`, tag, addr, src)
+		decision = decisionDirect
+		nextHop, err = c.dialDirect(addr.String())
+	}
+
+	ruleDecisions.Inc(decision)
+	return
+}
+
+// dialDirect connects to addr directly within the dial timeout
+func (c *Client) dialDirect(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, c.Config.DialTimeout)
+	if err != nil {
+		dialFailures.Inc("remote", metrics.ErrReason(err))
+		return nil, fmt.Errorf("dial remote failed: %s", err)
+	}
+	return conn, nil
+}
+
+// dialProxied connects to addr via a server of the group
+func (c *Client) dialProxied(group string, addr *socks.Addr) (net.Conn, error) {
+	ser, err := c.dialGroup(group)
+	if err != nil {
+		return nil, fmt.Errorf("dial server failed: %s", err)
+	}
+	if err := requestConnect(ser, addr); err != nil {
+		ser.Close()
+		return nil, err
+	}
+	return ser, nil
+}
+
+// dialAuto races the direct dial against the proxied one, which starts
+// after the auto delay or once the direct one fails. The first connection
+// wins and the other one is closed.
+func (c *Client) dialAuto(addr *socks.Addr) (net.Conn, string, error) {
+	type result struct {
+		conn     net.Conn
+		decision string
+		err      error
+	}
+	results := make(chan result, 2)
+
+	go func() {
+		conn, err := c.dialDirect(addr.String())
+		results <- result{conn, decisionDirect, err}
+	}()
+
+	delay := time.NewTimer(c.Config.AutoDelay)
+	defer delay.Stop()
+
+	var errs []string
+	pending, proxied := 1, false
+	for pending > 0 {
+		select {
+		case <-delay.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					go func() {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, r.decision, nil
+			}
+			errs = append(errs, r.err.Error())
+		}
+
+		if !proxied {
+			proxied = true
+			pending++
+			go func() {
+				conn, err := c.dialProxied("", addr)
+				results <- result{conn, decisionAutoFallback, err}
+			}()
+		}
+	}
+	return nil, decisionAutoFallback, errors.New(strings.Join(errs, ", "))
+}
+
+// requestConnect sends the connect request to the server and waits for
+// the reply
+func requestConnect(ser net.Conn, addr *socks.Addr) error {
+	if err := socks.NewRequest(socks.CmdConnect, addr).Write(ser); err != nil {
+		return fmt.Errorf("send request failed: %s", err)
+	}
+	r, err := socks.ReadReply(ser)
+	if err != nil {
+		return fmt.Errorf("read reply failed: %s", err)
+	}
+	if r.Rep != socks.Succeeded {
+		return &replyError{r.Rep}
+	}
+	return nil
+}
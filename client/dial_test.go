@@ -0,0 +1,87 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+// connectServer is a socks5 server that accepts connect requests and
+// writes "proxied" to the connections
+func connectServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				socks.ReadMethods(conn)
+				socks.WriteMethod(socks.MethodNoAuth, conn)
+				if req, err := socks.ReadRequest(conn); err != nil || req.Cmd != socks.CmdConnect {
+					return
+				}
+				socks.NewReply(socks.Succeeded, nil).Write(conn)
+				conn.Write([]byte("proxied"))
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestDialAuto(t *testing.T) {
+	ser := connectServer(t)
+	defer ser.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	closed := socks.NewAddrFromPair("127.0.0.1", target.Addr().(*net.TCPAddr).Port)
+	defer target.Close()
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Servers = []*Upstream{{Protocol: "socks", Addr: ser.Addr().String()}}
+	cli.Config.DialTimeout = 2 * time.Second
+	cli.Config.AutoDelay = time.Second
+	cli.Rules, err = NewRulesFromMap(map[string]string{"*": "A"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	// the direct dial wins before the delay
+	addr, _ := socks.NewAddr(target.Addr().String())
+	conn, decision, err := cli.dialTarget("test", addr, "direct.example.com", nil)
+	if err != nil || decision != decisionDirect {
+		t.Fatalf("Dial reachable target got %q, %v, want %q", decision, err, decisionDirect)
+	}
+	conn.Close()
+
+	// the direct dial is refused, the server wins without waiting
+	target.Close()
+	start := time.Now()
+	conn, decision, err = cli.dialTarget("test", closed, "refused.example.com", nil)
+	if err != nil || decision != decisionAutoFallback {
+		t.Fatalf("Dial refused target got %q, %v, want %q", decision, err, decisionAutoFallback)
+	}
+	conn.Close()
+	if d := time.Since(start); d >= cli.Config.AutoDelay {
+		t.Fatalf("Dial refused target took %s, want less than the delay", d)
+	}
+	if rule := cli.Rules.getRule("refused.example.com", 0); rule != ruleProxy {
+		t.Fatalf("Rule of the winner got %d, want %d", rule, ruleProxy)
+	}
+
+	// both fail
+	cli.Config.Servers[0].Addr = closed.String()
+	if _, _, err = cli.dialTarget("test", closed, "down.example.com", nil); err == nil {
+		t.Fatalf("Dial with the server down should fail")
+	}
+}
@@ -0,0 +1,365 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+const (
+	// dnsTimeout is the time to wait for an answer from resolvers
+	dnsTimeout = 5 * time.Second
+	// dnsTCPIdle closes a TCP DNS connection if there's no query in it
+	dnsTCPIdle = 10 * time.Second
+)
+
+// DNS response codes
+const (
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeRefused  = 5
+)
+
+var errDNSChannelClosed = errors.New("DNS channel closed")
+
+// serverResolver is the destination that asks the server to resolve by
+// its own resolver
+var serverResolver = socks.NewAddrFromPair("0.0.0.0", 53)
+
+// DNS answers queries of the listening address, domains that go directly
+// are resolved by the local resolver, others by the remote one via servers.
+// If FakeIP is set, A queries are answered with fake IPs of the range
+// instead, connections to them are turned back into the domains.
+type DNS struct {
+	Listen string
+	Remote string // empty means the resolver of the server
+	Local  string
+	FakeIP string
+}
+
+type dnsForwarder struct {
+	client *Client
+	remote *socks.Addr
+	local  string
+
+	mu       sync.Mutex
+	channels map[string]*dnsChannel // UDP over TCP channel of each group
+}
+
+func (c *Client) listenDNS(d *DNS) error {
+	f := &dnsForwarder{
+		client:   c,
+		remote:   serverResolver,
+		local:    d.Local,
+		channels: make(map[string]*dnsChannel),
+	}
+	if d.Remote != "" {
+		remote, err := socks.NewAddr(d.Remote)
+		if err != nil {
+			return err
+		}
+		f.remote = remote
+	}
+
+	udp, err := net.ListenPacket("udp", d.Listen)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", d.Listen)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+
+	log.Printf("Client starts to listen dns://%s", udp.LocalAddr().String())
+	go f.serveUDP(udp)
+	go f.serveTCP(tcp)
+	return nil
+}
+
+func (f *dnsForwarder) serveUDP(conn net.PacketConn) {
+	b := utils.LPool.Get().([]byte)
+	defer utils.LPool.Put(b)
+
+	for {
+		n, peer, err := conn.ReadFrom(b)
+		if err != nil {
+			log.Printf(`[dns] read UDP failed: %s`, err)
+			return
+		}
+
+		query := append([]byte(nil), b[:n]...)
+		go func() {
+			if res := f.answer(query, peer); res != nil {
+				conn.WriteTo(res, peer)
+			}
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Acceptance failed: %s", err)
+			continue
+		}
+
+		go f.tcpHandler(conn)
+	}
+}
+
+// tcpHandler answers queries prefixed with two bytes length
+func (f *dnsForwarder) tcpHandler(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsTCPIdle))
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		res := f.answer(query, conn.RemoteAddr())
+		if res == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(l[:], uint16(len(res)))
+		if _, err := conn.Write(append(l[:], res...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer resolves the query according to the rules, it returns nil if the
+// query is too short to reply
+func (f *dnsForwarder) answer(query []byte, src net.Addr) []byte {
+	name, end, ok := parseDNSQuestion(query)
+	if !ok {
+		return dnsError(query, 0, rcodeFormErr)
+	}
+
+	rule := f.client.Rules.getRule(name, 0)
+	if f.client.Rules.rejected(name) {
+		log.Printf(`[dns] reject %s for %s`, name, src)
+		return dnsError(query, end, rcodeRefused)
+	}
+	if f.client.fakeIPs != nil {
+		if res := f.client.fakeIPs.answer(query, name, end); res != nil {
+			log.Printf(`[dns] answer %s with fake IP for %s`, name, src)
+			return res
+		}
+	}
+
+	var res []byte
+	var err error
+	// rejected domains reach here if port rules allow them
+	if rule == ruleDirect || rule == ruleReject {
+		log.Printf(`[dns] resolve %s locally for %s`, name, src)
+		res, err = f.exchangeLocal(query)
+	} else {
+		log.Printf(`[dns] resolve %s remotely for %s`, name, src)
+		res, err = f.channel(f.client.Rules.groupOf(rule)).exchange(query)
+	}
+
+	if err != nil {
+		log.Printf(`[dns] resolve %s failed: %s`, name, err)
+		return dnsError(query, end, rcodeServFail)
+	}
+	return res
+}
+
+func (f *dnsForwarder) exchangeLocal(query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", f.local)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 64*1024)
+	n, err := conn.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+func (f *dnsForwarder) channel(group string) *dnsChannel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := f.channels[group]
+	if ch == nil {
+		ch = &dnsChannel{forwarder: f, group: group, pending: make(map[uint16]chan []byte)}
+		f.channels[group] = ch
+	}
+	return ch
+}
+
+// dnsChannel sends queries to the remote resolver through a UDP over TCP
+// channel. IDs of queries are rewritten to tell their answers apart.
+type dnsChannel struct {
+	forwarder *dnsForwarder
+	group     string
+
+	mu      sync.Mutex
+	ser     net.Conn
+	nextID  uint16
+	pending map[uint16]chan []byte
+}
+
+func (ch *dnsChannel) exchange(query []byte) ([]byte, error) {
+	reply := make(chan []byte, 1)
+
+	ch.mu.Lock()
+	if ch.ser == nil {
+		ser, err := ch.forwarder.client.requestServer4UDP(ch.group)
+		if err != nil {
+			ch.mu.Unlock()
+			return nil, err
+		}
+		ch.ser = ser
+		go ch.readReplies(ser)
+	}
+	ser := ch.ser
+
+	for {
+		ch.nextID++
+		if _, ok := ch.pending[ch.nextID]; !ok {
+			break
+		}
+	}
+	id := ch.nextID
+	ch.pending[id] = reply
+
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg, id)
+	dgram := socks.NewUDPDatagram(socks.NewUDPHeader(uint16(len(msg)), 0, ch.forwarder.remote), msg)
+	err := dgram.Write(ser)
+	ch.mu.Unlock()
+
+	defer func() {
+		ch.mu.Lock()
+		delete(ch.pending, id)
+		ch.mu.Unlock()
+	}()
+
+	if err != nil {
+		ser.Close()
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-reply:
+		if !ok {
+			return nil, errDNSChannelClosed
+		}
+		copy(res[:2], query[:2])
+		return res, nil
+	case <-time.After(dnsTimeout):
+		return nil, errors.New("DNS query timeout")
+	}
+}
+
+func (ch *dnsChannel) readReplies(ser net.Conn) {
+	for {
+		dgram, err := socks.ReadUDPDatagram(ser)
+		if err != nil {
+			break
+		}
+		if len(dgram.Data) < 12 {
+			continue
+		}
+
+		id := binary.BigEndian.Uint16(dgram.Data)
+		ch.mu.Lock()
+		reply := ch.pending[id]
+		delete(ch.pending, id)
+		ch.mu.Unlock()
+		if reply != nil {
+			reply <- dgram.Data
+		}
+	}
+
+	ch.mu.Lock()
+	if ch.ser == ser {
+		ch.ser = nil
+	}
+	for id, reply := range ch.pending {
+		close(reply)
+		delete(ch.pending, id)
+	}
+	ch.mu.Unlock()
+	ser.Close()
+}
+
+// parseDNSQuestion returns the lowercase name of the first question, and
+// the offset where the question ends
+func parseDNSQuestion(msg []byte) (name string, end int, ok bool) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return "", 0, false
+	}
+
+	var labels []string
+	p := 12
+	for {
+		if p >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[p])
+		p++
+		if l == 0 {
+			break
+		}
+		// compression isn't expected in the first question
+		if l&0xc0 != 0 || p+l > len(msg) {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[p:p+l]))
+		p += l
+	}
+
+	// type and class
+	if p+4 > len(msg) {
+		return "", 0, false
+	}
+	return strings.ToLower(strings.Join(labels, ".")), p + 4, true
+}
+
+// dnsError makes an answer of the query with the response code, the
+// question is kept if end is not zero
+func dnsError(query []byte, end int, rcode byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	if end < 12 {
+		end = 12
+	}
+
+	res := append([]byte(nil), query[:end]...)
+	res[2] = 0x80 | query[2]&0x79 // QR, opcode and RD
+	res[3] = 0x80 | rcode         // RA
+	if end == 12 {
+		res[4], res[5] = 0, 0
+	}
+	for i := 6; i < 12; i++ {
+		res[i] = 0
+	}
+	return res
+}
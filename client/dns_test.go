@@ -0,0 +1,145 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func dnsQuery(id uint16, name string) []byte {
+	b := []byte{byte(id >> 8), byte(id), 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, l := range strings.Split(name, ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0, 0, 1, 0, 1)
+}
+
+func TestParseDNSQuestion(t *testing.T) {
+	q := dnsQuery(1, "WWW.Example.com")
+	name, end, ok := parseDNSQuestion(q)
+	if !ok || name != "www.example.com" || end != len(q) {
+		t.Fatalf("Parse got %q, %d, %v, want %q, %d, true", name, end, ok, "www.example.com", len(q))
+	}
+
+	for _, b := range [][]byte{
+		q[:11],
+		q[:len(q)-1],
+		append(q[:12:12], 0xc0, 12, 0, 1, 0, 1),
+		{0, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, _, ok := parseDNSQuestion(b); ok {
+			t.Fatalf("Parse %v should fail", b)
+		}
+	}
+
+	res := dnsError(q, end, rcodeRefused)
+	if len(res) != len(q) || res[2]&0x80 == 0 || res[3]&0xf != rcodeRefused || res[0] != q[0] || res[1] != q[1] {
+		t.Fatalf("Error response got %v", res)
+	}
+}
+
+func TestDNSForwarder(t *testing.T) {
+	// the server echoes queries to the remote resolver, with a trailing 'R'
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				socks.ReadMethods(conn)
+				socks.WriteMethod(socks.MethodNoAuth, conn)
+				if req, err := socks.ReadRequest(conn); err != nil || req.Cmd != socks.CmdUDPOverTCP {
+					return
+				}
+				socks.NewReply(socks.Succeeded, nil).Write(conn)
+				for {
+					dgram, err := socks.ReadUDPDatagram(conn)
+					if err != nil {
+						return
+					}
+					if dgram.Header.Addr.String() != serverResolver.String() {
+						continue
+					}
+					data := append(dgram.Data, 'R')
+					socks.NewUDPDatagram(socks.NewUDPHeader(uint16(len(data)), 0, dgram.Header.Addr), data).Write(conn)
+				}
+			}()
+		}
+	}()
+
+	// the local resolver echoes queries with a trailing 'L'
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer local.Close()
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := local.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			local.WriteTo(append(b[:n:n], 'L'), addr)
+		}
+	}()
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Servers = []*Upstream{{Protocol: "socks", Addr: ln.Addr().String()}}
+	cli.Rules, err = NewRulesFromMap(map[string]string{
+		"*.direct.com":  "D",
+		"*.blocked.com": "R",
+		"*":             "P",
+	})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	f := &dnsForwarder{
+		client:   cli,
+		remote:   serverResolver,
+		local:    local.LocalAddr().String(),
+		channels: make(map[string]*dnsChannel),
+	}
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+	res := f.answer(dnsQuery(7, "www.direct.com"), src)
+	if res == nil || res[len(res)-1] != 'L' {
+		t.Fatalf("Direct answer got %v, want from the local resolver", res)
+	}
+
+	res = f.answer(dnsQuery(7, "www.blocked.com"), src)
+	if res == nil || res[3]&0xf != rcodeRefused {
+		t.Fatalf("Rejected answer got %v, want refused", res)
+	}
+
+	// concurrent queries with the same ID get their own answers
+	var wg sync.WaitGroup
+	errc := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			q := dnsQuery(7, name)
+			res := f.answer(q, src)
+			if len(res) != len(q)+1 || res[len(res)-1] != 'R' || string(res[:len(q)]) != string(q) {
+				errc <- name
+			}
+		}(strings.Repeat("a", i+1) + ".example.com")
+	}
+	wg.Wait()
+	close(errc)
+	for name := range errc {
+		t.Fatalf("Remote answer of %s is wrong", name)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+// fakeIPTTL is the TTL in seconds of fake answers
+const fakeIPTTL = 60
+
+// DNS query types
+const (
+	qtypeA    = 1
+	qtypeAAAA = 28
+)
+
+var errUnknownFakeIP = errors.New("Unknown fake IP")
+
+// fakeIPPool hands out addresses of a reserved range to domains, and maps
+// them back. When the range runs out, the least recently assigned
+// addresses are reused.
+type fakeIPPool struct {
+	mu       sync.Mutex
+	network  *net.IPNet
+	base     uint32
+	size     uint32
+	next     uint32
+	byDomain map[string]uint32
+	byOffset map[uint32]string
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 32 || bits-ones < 2 || bits-ones > 24 {
+		return nil, fmt.Errorf("Fake IP range %s should be an IPv4 CIDR from /8 to /30", cidr)
+	}
+
+	return &fakeIPPool{
+		network:  network,
+		base:     binary.BigEndian.Uint32(ip),
+		size:     1 << uint(bits-ones),
+		next:     1, // skip the network address
+		byDomain: make(map[string]uint32),
+		byOffset: make(map[uint32]string),
+	}, nil
+}
+
+// get returns the fake IP of the domain, assigns one if there's none
+func (p *fakeIPPool) get(domain string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	offset, ok := p.byDomain[domain]
+	if !ok {
+		offset = p.next
+		if p.next++; p.next >= p.size-1 { // skip the broadcast address
+			p.next = 1
+		}
+		if old, ok := p.byOffset[offset]; ok {
+			delete(p.byDomain, old)
+		}
+		p.byDomain[domain] = offset
+		p.byOffset[offset] = domain
+	}
+
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.base+offset)
+	return ip
+}
+
+// lookup returns the domain of the fake IP
+func (p *fakeIPPool) lookup(ip net.IP) (string, bool) {
+	ip = ip.To4()
+	if ip == nil || !p.network.Contains(ip) {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domain, ok := p.byOffset[binary.BigEndian.Uint32(ip)-p.base]
+	return domain, ok
+}
+
+// realAddr turns addr into the domain if it's a fake IP. It returns
+// errUnknownFakeIP if it's in the fake range but not assigned.
+func (c *Client) realAddr(addr *socks.Addr) (*socks.Addr, error) {
+	if c.fakeIPs == nil || addr.Type != socks.AddrIPv4 {
+		return addr, nil
+	}
+	ip := net.ParseIP(addr.Host)
+	if !c.fakeIPs.network.Contains(ip) {
+		return addr, nil
+	}
+	domain, ok := c.fakeIPs.lookup(ip)
+	if !ok {
+		return nil, errUnknownFakeIP
+	}
+	return socks.NewAddrFromPair(domain, int(addr.Port)), nil
+}
+
+// answer answers A queries with a fake IP, and AAAA queries with
+// nothing. It returns nil for other queries.
+func (p *fakeIPPool) answer(query []byte, name string, end int) []byte {
+	switch binary.BigEndian.Uint16(query[end-4:]) {
+	case qtypeA:
+		res := dnsError(query, end, 0)
+		binary.BigEndian.PutUint16(res[6:], 1) // ANCOUNT
+		res = append(res, 0xc0, 12)            // pointer to the question name
+		res = append(res, 0, qtypeA, 0, 1)
+		res = append(res, 0, 0, 0, fakeIPTTL)
+		res = append(res, 0, net.IPv4len)
+		return append(res, p.get(name)...)
+	case qtypeAAAA:
+		return dnsError(query, end, 0)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	if _, err := newFakeIPPool("fd00::/64"); err == nil {
+		t.Fatalf("IPv6 range should fail")
+	}
+	if _, err := newFakeIPPool("198.18.0.0/31"); err == nil {
+		t.Fatalf("Too small range should fail")
+	}
+
+	p, err := newFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatalf("Create pool failed: %s", err)
+	}
+
+	a := p.get("a.com")
+	b := p.get("b.com")
+	if a.String() != "198.18.0.1" || b.String() != "198.18.0.2" {
+		t.Fatalf("Get got %s, %s, want 198.18.0.1, 198.18.0.2", a, b)
+	}
+	if ip := p.get("a.com"); !ip.Equal(a) {
+		t.Fatalf("Get a.com again got %s, want %s", ip, a)
+	}
+	if domain, ok := p.lookup(b); !ok || domain != "b.com" {
+		t.Fatalf("Lookup %s got %q, %v, want b.com", b, domain, ok)
+	}
+
+	// the range is used up, the oldest one is reused
+	if ip := p.get("c.com"); !ip.Equal(a) {
+		t.Fatalf("Get c.com got %s, want %s", ip, a)
+	}
+	if domain, _ := p.lookup(a); domain != "c.com" {
+		t.Fatalf("Lookup %s got %q, want c.com", a, domain)
+	}
+	if _, ok := p.lookup(net.IPv4(198, 18, 0, 3)); ok {
+		t.Fatalf("Lookup the broadcast address should fail")
+	}
+	if _, ok := p.lookup(net.IPv4(1, 1, 1, 1)); ok {
+		t.Fatalf("Lookup an address out of the range should fail")
+	}
+}
+
+func TestFakeIPAnswer(t *testing.T) {
+	p, err := newFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatalf("Create pool failed: %s", err)
+	}
+
+	q := dnsQuery(7, "www.example.com")
+	name, end, _ := parseDNSQuestion(q)
+	res := p.answer(q, name, end)
+	if len(res) != len(q)+16 || res[0] != 0 || res[1] != 7 || res[3]&0xf != 0 ||
+		binary.BigEndian.Uint16(res[6:]) != 1 {
+		t.Fatalf("A answer got %v", res)
+	}
+	if ip := net.IP(res[len(res)-4:]); !ip.Equal(p.get("www.example.com")) {
+		t.Fatalf("A answer got IP %s", ip)
+	}
+
+	q[end-3] = qtypeAAAA
+	if res := p.answer(q, name, end); len(res) != len(q) || binary.BigEndian.Uint16(res[6:]) != 0 {
+		t.Fatalf("AAAA answer got %v, want no answers", res)
+	}
+
+	q[end-3] = 15 // MX
+	if res := p.answer(q, name, end); res != nil {
+		t.Fatalf("MX answer got %v, want nil", res)
+	}
+}
+
+func TestRealAddr(t *testing.T) {
+	c := NewClient("127.0.0.1:1030")
+	addr := socks.NewAddrFromPair("198.18.0.1", 443)
+	if got, err := c.realAddr(addr); err != nil || got != addr {
+		t.Fatalf("Real addr without fake IPs got %v, %v", got, err)
+	}
+
+	c.fakeIPs, _ = newFakeIPPool("198.18.0.0/15")
+	ip := c.fakeIPs.get("www.example.com")
+	got, err := c.realAddr(socks.NewAddrFromPair(ip.String(), 443))
+	if err != nil || got.Type != socks.AddrDomain || got.String() != "www.example.com:443" {
+		t.Fatalf("Real addr of %s got %v, %v", ip, got, err)
+	}
+
+	if _, err := c.realAddr(socks.NewAddrFromPair("198.18.0.100", 443)); err != errUnknownFakeIP {
+		t.Fatalf("Real addr of unknown fake IP got %v, want %v", err, errUnknownFakeIP)
+	}
+	if got, err := c.realAddr(socks.NewAddrFromPair("1.1.1.1", 53)); err != nil || got.String() != "1.1.1.1:53" {
+		t.Fatalf("Real addr of 1.1.1.1 got %v, %v", got, err)
+	}
+}
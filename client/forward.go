@@ -0,0 +1,212 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+// forwardUDPTimeout closes a UDP forwarding channel if the server sends
+// nothing back in this duration
+const forwardUDPTimeout = 60 * time.Second
+
+// Forward forwards connections of a local port to a fixed destination via
+// the server
+type Forward struct {
+	Network string // "tcp" or "udp"
+	Listen  string
+	Target  string
+	Group   string
+}
+
+func (f *Forward) String() string {
+	return fmt.Sprintf("%s://%s", f.Network, f.Listen)
+}
+
+func (c *Client) listenForward(f *Forward) error {
+	target, err := socks.NewAddr(f.Target)
+	if err != nil {
+		return fmt.Errorf("Invalid forward target %q: %s", f.Target, err)
+	}
+
+	switch f.Network {
+	case "tcp":
+		listener, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			return err
+		}
+		go c.serveForwardTCP(f, target, listener)
+	case "udp":
+		conn, err := net.ListenPacket("udp", f.Listen)
+		if err != nil {
+			return err
+		}
+		go c.serveForwardUDP(f, target, conn)
+	default:
+		return fmt.Errorf("Forward network got %q, want tcp|udp", f.Network)
+	}
+
+	log.Printf("Client starts to forward %s to %s", f, f.Target)
+	return nil
+}
+
+func (c *Client) serveForwardTCP(f *Forward, target *socks.Addr, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Acceptance failed: %s", err)
+			continue
+		}
+
+		go c.forwardHandler(f, target, conn)
+	}
+}
+
+func (c *Client) forwardHandler(f *Forward, target *socks.Addr, conn net.Conn) {
+	defer conn.Close()
+
+	log.Printf(`[forward] dial server to connect %s for %s`, target, conn.RemoteAddr())
+	ser, err := c.dialGroup(f.Group)
+	if err != nil {
+		log.Printf(`[forward] dial server failed: %s`, err)
+		return
+	}
+	defer ser.Close()
+
+	if err := requestConnect(ser, target); err != nil {
+		log.Printf(`[forward] %s`, err)
+		return
+	}
+
+	log.Printf(`[forward] tunnel established %s <-> %s`, conn.RemoteAddr(), target)
+	t := &tunnel.Tunnel{
+		Command:     "connect",
+		Source:      conn.RemoteAddr().String(),
+		Destination: target.String(),
+		Rule:        decisionProxy,
+	}
+	if err := c.transport(t, conn, ser); err != nil {
+		log.Printf(`[forward] transport failed: %s`, err)
+	}
+	log.Printf(`[forward] tunnel disconnected %s >-< %s`, conn.RemoteAddr(), target)
+}
+
+// forwardUDPQueue is the number of datagrams of a peer waiting for the
+// channel, more are dropped
+const forwardUDPQueue = 64
+
+// udpChannel is a UDP over TCP channel of a local peer
+type udpChannel struct {
+	queue  chan []byte // datagrams to send to the server
+	tunnel *tunnel.Tunnel
+}
+
+// serveForwardUDP requests a UDP over TCP channel for each local peer
+func (c *Client) serveForwardUDP(f *Forward, target *socks.Addr, conn net.PacketConn) {
+	var mu sync.Mutex
+	channels := make(map[string]*udpChannel)
+
+	b := utils.LPool.Get().([]byte)
+	defer utils.LPool.Put(b)
+
+	for {
+		n, peer, err := conn.ReadFrom(b)
+		if err != nil {
+			log.Printf(`[forward] read UDP failed: %s`, err)
+			return
+		}
+
+		mu.Lock()
+		ch := channels[peer.String()]
+		if ch == nil {
+			// the channel is set up in another goroutine, so that a slow
+			// server doesn't hold up other peers
+			ch = &udpChannel{
+				queue: make(chan []byte, forwardUDPQueue),
+				tunnel: &tunnel.Tunnel{
+					Command:     "udp",
+					Source:      "(UDP)" + peer.String(),
+					Destination: target.String(),
+					Rule:        decisionProxy,
+				},
+			}
+			channels[peer.String()] = ch
+			go func(peer net.Addr, ch *udpChannel) {
+				c.forwardUDPChannel(f, target, conn, peer, ch)
+				mu.Lock()
+				delete(channels, peer.String())
+				mu.Unlock()
+			}(peer, ch)
+		}
+		mu.Unlock()
+
+		select {
+		case ch.queue <- append([]byte(nil), b[:n]...):
+		default:
+			log.Printf(`[forward] UDP datagram from %s dropped, the queue is full`, peer)
+		}
+	}
+}
+
+// forwardUDPChannel requests a UDP over TCP channel for the peer, and relays
+// datagrams until the server sends nothing back for a while
+func (c *Client) forwardUDPChannel(f *Forward, target *socks.Addr, conn net.PacketConn, peer net.Addr, ch *udpChannel) {
+	ser, err := c.requestServer4UDP(f.Group)
+	if err != nil {
+		log.Printf(`[forward] request UDP over TCP failed: %s`, err)
+		return
+	}
+
+	log.Printf(`[forward] tunnel established (UDP)%s <-> %s`, peer, target)
+	c.openTunnel(ch.tunnel, ser)
+	defer c.closeTunnel(ch.tunnel)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := relayUDPReplies(conn, peer, ser, ch.tunnel); err != nil {
+			log.Printf(`[forward] relay UDP failed: %s`, err)
+		}
+	}()
+
+loop:
+	for {
+		select {
+		case data := <-ch.queue:
+			dgram := socks.NewUDPDatagram(socks.NewUDPHeader(uint16(len(data)), 0, target), data)
+			if err := dgram.Write(ser); err != nil {
+				log.Printf(`[forward] write UDP datagram failed: %s`, err)
+				break loop
+			}
+			countUp(ch.tunnel, len(data))
+		case <-done:
+			break loop
+		}
+	}
+	ser.Close()
+	<-done
+	log.Printf(`[forward] tunnel disconnected (UDP)%s >-< %s`, peer, target)
+}
+
+func relayUDPReplies(conn net.PacketConn, peer net.Addr, ser net.Conn, t *tunnel.Tunnel) error {
+	for {
+		ser.SetReadDeadline(time.Now().Add(forwardUDPTimeout))
+		dgram, err := socks.ReadUDPDatagram(ser)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return nil
+			}
+			return err
+		}
+		if _, err := conn.WriteTo(dgram.Data, peer); err != nil {
+			return err
+		}
+		countDown(t, len(dgram.Data))
+	}
+}
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+// forwardServer is a socks5 server that echoes connections and datagrams
+// back. Replies to UDP over TCP requests wait for hold if udpHold returns
+// true.
+func forwardServer(t *testing.T, udpHold func() bool, hold <-chan struct{}) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				socks.ReadMethods(conn)
+				socks.WriteMethod(socks.MethodNoAuth, conn)
+				req, err := socks.ReadRequest(conn)
+				if err != nil {
+					return
+				}
+				switch req.Cmd {
+				case socks.CmdConnect:
+					// the reply may be read along with the data after it,
+					// so the address is echoed after the client speaks
+					socks.NewReply(socks.Succeeded, nil).Write(conn)
+					b := make([]byte, 1024)
+					n, err := conn.Read(b)
+					if err != nil {
+						return
+					}
+					conn.Write(append([]byte(req.Addr.String()+" "), b[:n]...))
+					io.Copy(conn, conn)
+				case socks.CmdUDPOverTCP:
+					if udpHold() {
+						<-hold
+					}
+					socks.NewReply(socks.Succeeded, nil).Write(conn)
+					for {
+						dgram, err := socks.ReadUDPDatagram(conn)
+						if err != nil {
+							return
+						}
+						data := append([]byte(dgram.Header.Addr.String()+" "), dgram.Data...)
+						dgram = socks.NewUDPDatagram(socks.NewUDPHeader(uint16(len(data)), 0, dgram.Header.Addr), data)
+						if dgram.Write(conn) != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestForwardTCP(t *testing.T) {
+	ser := forwardServer(t, func() bool { return false }, nil)
+	defer ser.Close()
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Servers = []*Upstream{{Protocol: "socks", Addr: ser.Addr().String()}}
+
+	f := &Forward{Network: "tcp", Listen: "127.0.0.1:0", Target: "example.com:80"}
+	target, _ := socks.NewAddr(f.Target)
+	ln, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go cli.serveForwardTCP(f, target, ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial forward failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	want := "example.com:80 hello"
+	b := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != want {
+		t.Fatalf("Read got %q, %v, want %q", b, err, want)
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	// the channel of the first peer is held up by the server
+	var requests int32
+	hold := make(chan struct{})
+	defer close(hold)
+	ser := forwardServer(t, func() bool { return atomic.AddInt32(&requests, 1) == 1 }, hold)
+	defer ser.Close()
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Servers = []*Upstream{{Protocol: "socks", Addr: ser.Addr().String()}}
+
+	f := &Forward{Network: "udp", Listen: "127.0.0.1:0", Target: "8.8.8.8:53"}
+	target, _ := socks.NewAddr(f.Target)
+	conn, err := net.ListenPacket("udp", f.Listen)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer conn.Close()
+	go cli.serveForwardUDP(f, target, conn)
+
+	slow, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial forward failed: %s", err)
+	}
+	defer slow.Close()
+	if _, err := slow.Write([]byte("slow")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	for atomic.LoadInt32(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// other peers go on while the first one waits
+	peer, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial forward failed: %s", err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(2 * time.Second))
+	for _, data := range []string{"hello", "world"} {
+		if _, err := peer.Write([]byte(data)); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		b := make([]byte, 1024)
+		n, err := peer.Read(b)
+		if want := "8.8.8.8:53 " + data; err != nil || string(b[:n]) != want {
+			t.Fatalf("Read got %q, %v, want %q", b[:n], err, want)
+		}
+	}
+}
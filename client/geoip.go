@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// geoResolveTimeout is the time to wait for resolving a domain
+	geoResolveTimeout = 3 * time.Second
+	// geoResolveTTL is how long a resolved IP is used
+	geoResolveTTL = 10 * time.Minute
+	// geoResolveFailureTTL is how long a domain failed to resolve is not
+	// resolved again
+	geoResolveFailureTTL = time.Minute
+	// geoResolveCacheSize is the most resolved domains to keep
+	geoResolveCacheSize = 10000
+)
+
+// geoIPPrefix starts rule addresses of countries, e.g. "GEOIP,CN"
+const geoIPPrefix = "GEOIP,"
+
+type resolvedIP struct {
+	ip      net.IP // nil if resolving failed
+	expires time.Time
+}
+
+// geoIP looks up countries of IPs in a MaxMind DB file, e.g. GeoLite2 or
+// DB-IP country databases
+type geoIP struct {
+	db      *maxminddb.Reader
+	resolve bool // whether to resolve domains to match IP rules
+
+	mu       sync.Mutex
+	resolved map[string]resolvedIP
+}
+
+// LoadGeoIP loads the MaxMind DB file for GEOIP rules. If resolve is true,
+// domains without rules are resolved to match IP and GEOIP rules.
+func (r *Rules) LoadGeoIP(path string, resolve bool) error {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	r.geoIP = &geoIP{
+		db:       db,
+		resolve:  resolve,
+		resolved: make(map[string]resolvedIP),
+	}
+	return nil
+}
+
+// country returns the ISO country code of ip, empty if it's unknown
+func (g *geoIP) country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// lookupIP resolves the domain by the system resolver, results are cached
+// for a while. It returns nil if resolving fails.
+func (g *geoIP) lookupIP(domain string) net.IP {
+	g.mu.Lock()
+	res, ok := g.resolved[domain]
+	g.mu.Unlock()
+	if ok && time.Now().Before(res.expires) {
+		return res.ip
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), geoResolveTimeout)
+	defer cancel()
+	var ip net.IP
+	if addrs, err := net.DefaultResolver.LookupIPAddr(ctx, domain); err == nil && len(addrs) > 0 {
+		ip = addrs[0].IP
+		for _, a := range addrs {
+			if a.IP.To4() != nil {
+				ip = a.IP
+				break
+			}
+		}
+	}
+
+	ttl := geoResolveTTL
+	if ip == nil {
+		ttl = geoResolveFailureTTL
+	}
+
+	g.mu.Lock()
+	if len(g.resolved) >= geoResolveCacheSize {
+		g.resolved = make(map[string]resolvedIP)
+	}
+	g.resolved[domain] = resolvedIP{ip, time.Now().Add(ttl)}
+	g.mu.Unlock()
+	return ip
+}
+
+// parseGeoIPAddr returns the country code if addr is a GEOIP address
+func parseGeoIPAddr(addr string) (string, bool) {
+	country, ok := cutPrefixFold(addr, geoIPPrefix)
+	return strings.ToUpper(country), ok
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdbString encodes a UTF-8 string of MaxMind DB
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint encodes an unsigned integer of the type in 2 bytes
+func mmdbUint(typ byte, n uint16) []byte {
+	return []byte{typ<<5 | 2, byte(n >> 8), byte(n)}
+}
+
+// writeGeoIPDB writes an IPv4 MaxMind DB in which 1.0.0.0/8 is in CN
+func writeGeoIPDB(t *testing.T) string {
+	const nodeCount = 8
+
+	// 0000000 leads to the next node, then 1 leads to the data
+	var db []byte
+	record := func(v int) {
+		db = append(db, byte(v>>16), byte(v>>8), byte(v))
+	}
+	for i := 0; i < nodeCount-1; i++ {
+		record(i + 1)
+		record(nodeCount)
+	}
+	record(nodeCount)
+	record(nodeCount + 16)
+
+	db = append(db, make([]byte, 16)...)
+	db = append(db, 7<<5|1) // map {"country": {"iso_code": "CN"}}
+	db = append(db, mmdbString("country")...)
+	db = append(db, 7<<5|1)
+	db = append(db, mmdbString("iso_code")...)
+	db = append(db, mmdbString("CN")...)
+
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, 7<<5|5)
+	db = append(db, mmdbString("binary_format_major_version")...)
+	db = append(db, mmdbUint(5, 2)...)
+	db = append(db, mmdbString("node_count")...)
+	db = append(db, mmdbUint(6, nodeCount)...)
+	db = append(db, mmdbString("record_size")...)
+	db = append(db, mmdbUint(5, 24)...)
+	db = append(db, mmdbString("ip_version")...)
+	db = append(db, mmdbUint(5, 4)...)
+	db = append(db, mmdbString("database_type")...)
+	db = append(db, mmdbString("Test-Country")...)
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := ioutil.WriteFile(path, db, 0644); err != nil {
+		t.Fatalf("Write DB failed: %s", err)
+	}
+	return path
+}
+
+func TestRulesGeoIP(t *testing.T) {
+	r, err := NewRulesFromMap(map[string]string{
+		"GEOIP,cn":    "D",
+		"1.2.3.4":     "R",
+		"*.localhost": "P",
+		"*":           "P",
+	})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	// GEOIP rules don't work without the DB
+	if rule := r.getRule("1.2.3.5", 0); rule != ruleProxy {
+		t.Fatalf("Rule of 1.2.3.5 without DB got %d, want %d", rule, ruleProxy)
+	}
+
+	if err := r.LoadGeoIP(writeGeoIPDB(t), true); err != nil {
+		t.Fatalf("Load GeoIP failed: %s", err)
+	}
+	r.geoIP.resolved["cn.example.com"] = resolvedIP{ip: []byte{1, 1, 1, 1}, expires: time.Now().Add(time.Hour)}
+	r.geoIP.resolved["us.example.com"] = resolvedIP{ip: []byte{8, 8, 8, 8}, expires: time.Now().Add(time.Hour)}
+
+	cases := []struct {
+		addr    string
+		resolve bool
+		rule    int
+	}{
+		{"1.2.3.5", false, ruleDirect},
+		{"1.2.3.4", false, ruleReject}, // IP rules go first
+		{"8.8.8.8", false, ruleProxy},
+		{"cn.example.com", false, ruleProxy},
+		{"cn.example.com", true, ruleDirect},
+		{"us.example.com", true, ruleProxy},
+		{"a.localhost", true, ruleProxy}, // domain rules go first
+	}
+	for _, c := range cases {
+		if rule := r.lookupRule(c.addr, 0, c.resolve); rule != c.rule {
+			t.Fatalf("Rule of %s with resolving %v got %d, want %d", c.addr, c.resolve, rule, c.rule)
+		}
+	}
+}
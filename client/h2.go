@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/luyuhuang/subsocks/utils"
+	"golang.org/x/net/http2"
+)
+
+var h2Transport = newH2Transport()
+
+func newH2Transport() *http2.Transport {
+	// connections are closed once idle for a while, the idle timeout can
+	// only be set via an HTTP/1 transport
+	t, _ := http2.ConfigureTransports(&http.Transport{IdleConnTimeout: 5 * time.Minute})
+	// ping the server if nothing is received for a while, so a connection
+	// dropped silently is found
+	t.ReadIdleTimeout = 30 * time.Second
+	return t
+}
+
+// h2Conn is an HTTP/2 connection to the server
+type h2Conn struct {
+	*http2.ClientConn
+	conn net.Conn
+}
+
+func (u *Upstream) wrapH2(conn net.Conn) net.Conn {
+	config := u.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.NextProtos = []string{"h2"}
+	return tls.Client(conn, config)
+}
+
+// openH2Stream opens a tunnel as a stream of a shared HTTP/2 connection,
+// the request body carries data to the server and the response body
+// carries data back.
+func (u *Upstream) openH2Stream(timeout time.Duration) (net.Conn, error) {
+	cc, err := u.getH2Conn(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "https://"+u.Addr+u.HTTPPath, pr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Username != "" && u.Password != "" {
+		s := base64.StdEncoding.EncodeToString([]byte(u.Username + ":" + u.Password))
+		req.Header.Set("Authorization", "Basic "+s)
+	}
+
+	// the context lives as long as the stream, so it's canceled by a timer
+	// rather than a deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+	res, err := cc.RoundTrip(req.WithContext(ctx))
+	if err == nil && timer != nil && !timer.Stop() {
+		res.Body.Close()
+		err = errors.New("Open stream timed out")
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		cancel()
+		pw.Close()
+		return nil, fmt.Errorf("Response status is not OK: %s", res.Status)
+	}
+
+	return utils.NewStreamConn(res.Body, pw, func() error {
+		pw.Close()
+		err := res.Body.Close()
+		cancel()
+		return err
+	}, cc.conn.LocalAddr(), cc.conn.RemoteAddr()), nil
+}
+
+// getH2Conn returns a connection to the server that can take a new stream,
+// creates one if there's none.
+func (u *Upstream) getH2Conn(timeout time.Duration) (*h2Conn, error) {
+	u.h2Mu.Lock()
+	defer u.h2Mu.Unlock()
+
+	var cc *h2Conn
+	conns := u.h2Conns[:0]
+	for _, c := range u.h2Conns {
+		// a full or closed connection is dropped, it's closed once idle
+		if !c.CanTakeNewRequest() {
+			continue
+		}
+		conns = append(conns, c)
+		if cc == nil {
+			cc = c
+		}
+	}
+	u.h2Conns = conns
+	if cc != nil {
+		return cc, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", u.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	tlsConn := u.wrapH2(conn).(*tls.Conn)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		conn.Close()
+		return nil, fmt.Errorf("Server doesn't speak HTTP/2, negotiated %q", proto)
+	}
+	c, err := h2Transport.NewClientConn(tlsConn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("[h2] connection established with %s", u)
+	cc = &h2Conn{c, tlsConn}
+	u.h2Conns = append(u.h2Conns, cc)
+	return cc, nil
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestH2WriteDeadline(t *testing.T) {
+	// the server never reads the request body, so writes get stuck once
+	// the flow control window is full
+	done := make(chan struct{})
+	defer close(done)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	u := &Upstream{
+		Protocol:  "h2",
+		Addr:      ts.Listener.Addr().String(),
+		HTTPPath:  "/",
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	conn, err := u.openH2Stream(5 * time.Second)
+	if err != nil {
+		t.Fatalf("Open stream failed: %s", err)
+	}
+	defer conn.Close()
+
+	// a stuck write is released by closing the conn if the deadline fails
+	watchdog := time.AfterFunc(5*time.Second, func() { conn.Close() })
+	defer watchdog.Stop()
+
+	conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	b := make([]byte, 64*1024)
+	for err == nil {
+		_, err = conn.Write(b)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if _, err := conn.Write(b); err == nil {
+		t.Fatalf("Write after the deadline succeeded")
+	}
+}
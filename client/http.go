@@ -12,15 +12,16 @@ import (
 	"net/http"
 
 	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
 	"github.com/luyuhuang/subsocks/utils"
 )
 
-func (c *Client) wrapHTTPS(conn net.Conn) net.Conn {
-	return c.wrapHTTP(tls.Client(conn, c.TLSConfig))
+func (u *Upstream) wrapHTTPS(conn net.Conn) net.Conn {
+	return u.wrapHTTP(tls.Client(conn, u.TLSConfig))
 }
 
-func (c *Client) wrapHTTP(conn net.Conn) net.Conn {
-	return newHTTPWrapper(conn, c)
+func (u *Upstream) wrapHTTP(conn net.Conn) net.Conn {
+	return newHTTPWrapper(conn, u)
 }
 
 func isValidHTTPProxyRequest(req *http.Request) bool {
@@ -45,123 +46,133 @@ func httpReply(statusCode int, status string) *http.Response {
 func (c *Client) httpHandler(conn net.Conn) {
 	defer conn.Close()
 
-	req, err := http.ReadRequest(bufio.NewReader(conn))
-	if err != nil {
-		log.Printf("[http] read HTTP request failed: %s", err)
-		return
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[http] read HTTP request failed: %s", err)
+			}
+			return
+		}
+		if !c.serveHTTP(&bufferedConn{conn, br}, req) {
+			return
+		}
 	}
+}
+
+// serveHTTP serves a request of the HTTP proxy, it returns whether the
+// connection can serve the next request
+func (c *Client) serveHTTP(conn net.Conn, req *http.Request) bool {
 	defer req.Body.Close()
 
+	if req.Method == http.MethodGet && req.URL.Host == "" && req.URL.Path == pacPath {
+		// the script reveals the rules, so it requires authorization too,
+		// which is in Authorization as it's not a proxy request
+		if c.Config.Verify != nil {
+			auth := req.Header.Get("Proxy-Authorization")
+			if auth == "" {
+				auth = req.Header.Get("Authorization")
+			}
+			if _, ok := utils.HttpBasicAuthUser(auth, c.Config.Verify); !ok {
+				authFailures.Inc("http")
+				reply := httpReply(http.StatusUnauthorized, "")
+				reply.Header = make(http.Header)
+				reply.Header.Add("WWW-Authenticate", `Basic realm="auth"`)
+				reply.Write(conn)
+				return false
+			}
+		}
+		c.servePAC(conn)
+		return !req.Close
+	}
+
 	if !isValidHTTPProxyRequest(req) {
 		log.Printf("[http] invalid http proxy request: %v", req)
 		httpReply(http.StatusBadRequest, "").Write(conn)
-		return
+		return false
 	}
 
+	var user string
 	if c.Config.Verify != nil {
-		if !utils.HttpBasicAuth(req.Header.Get("Proxy-Authorization"), c.Config.Verify) {
+		var ok bool
+		user, ok = utils.HttpBasicAuthUser(req.Header.Get("Proxy-Authorization"), c.Config.Verify)
+		if !ok {
+			authFailures.Inc("http")
 			reply := httpReply(http.StatusProxyAuthRequired, "")
 			reply.Header = make(http.Header)
 			reply.Header.Add("Proxy-Authenticate", `Basic realm="auth"`)
 			reply.Write(conn)
-			return
+			return false
 		}
 	}
 
-	host := req.URL.Hostname()
 	addr := req.URL.Host
 	if req.URL.Port() == "" {
 		addr = net.JoinHostPort(addr, "80")
 	}
-
-	var nextHop net.Conn
-	var isProxy bool
-	if rule := c.Rules.getRule(host); rule == ruleProxy {
-		log.Printf(`[http] dial server to connect %s for %s`, addr, conn.RemoteAddr())
-
-		isProxy = true
-		nextHop, err = c.dialServer()
-		if err != nil {
-			log.Printf(`[http] dial server failed: %s`, err)
-			httpReply(http.StatusServiceUnavailable, "").Write(conn)
-			return
-		}
-
-	} else {
-		log.Printf(`[http] dial %s for %s`, addr, conn.RemoteAddr())
-
-		nextHop, err = net.Dial("tcp", addr)
-		if err != nil {
-			if rule == ruleAuto {
-				log.Printf(`[http] dial %s failed, dial server for %s`, addr, conn.RemoteAddr())
-
-				isProxy = true
-				nextHop, err = c.dialServer()
-				if err != nil {
-					log.Printf(`[http] dial server failed: %s`, err)
-					httpReply(http.StatusServiceUnavailable, "").Write(conn)
-					return
-				}
-				c.Rules.setAsProxy(host)
-
-			} else {
-				log.Printf(`[http] dial remote failed: %s`, err)
-				httpReply(http.StatusServiceUnavailable, "").Write(conn)
-				return
-			}
-		}
-
+	socksAddr, err := socks.NewAddr(addr)
+	if err != nil {
+		log.Printf("[http] invalid address %s: %s", addr, err)
+		httpReply(http.StatusBadRequest, "").Write(conn)
+		return false
+	}
+	if socksAddr, err = c.realAddr(socksAddr); err != nil {
+		log.Printf("[http] %s %s from %s", err, addr, conn.RemoteAddr())
+		httpReply(http.StatusBadGateway, "").Write(conn)
+		return false
 	}
-	defer nextHop.Close()
 
-	var dash rune
-	if isProxy {
-		socksAddr, _ := socks.NewAddr(addr)
-		if err = socks.NewRequest(socks.CmdConnect, socksAddr).Write(nextHop); err != nil {
-			log.Printf(`[http] send request failed: %s`, err)
-			httpReply(http.StatusServiceUnavailable, "").Write(conn)
-			return
-		}
-		if r, e := socks.ReadReply(nextHop); e != nil {
-			log.Printf(`[http] read reply failed: %s`, err)
-			httpReply(http.StatusServiceUnavailable, "").Write(conn)
-			return
-		} else if r.Rep != socks.Succeeded {
-			log.Printf(`[http] server connect failed: %q`, r)
-			httpReply(http.StatusServiceUnavailable, "").Write(conn)
-			return
-		}
+	if req.Method != http.MethodConnect {
+		return c.forwardHTTP(conn, req, socksAddr, user)
+	}
+	addr = socksAddr.String()
 
-		dash = '-'
-	} else {
-		dash = '='
+	nextHop, decision, err := c.dialTarget("http", socksAddr, socksAddr.Host, conn.RemoteAddr())
+	if err == errRejected {
+		httpReply(http.StatusForbidden, "").Write(conn)
+		return false
+	} else if err != nil {
+		log.Printf(`[http] %s`, err)
+		httpReply(http.StatusServiceUnavailable, "").Write(conn)
+		return false
 	}
+	defer nextHop.Close()
 
-	if req.Method == http.MethodConnect {
-		// the response couldn't contains 'Content-Length: 0'
-		b := []byte("HTTP/1.1 200 Connection established\r\n\r\n")
-		if _, err = conn.Write(b); err != nil {
-			log.Printf(`[http] write reply failed: %s`, err)
-			return
-		}
-	} else {
-		req.Header.Del("Proxy-Connection")
-		if err = req.Write(nextHop); err != nil {
-			log.Printf(`[http] relay request failed: %s`, err)
-			return
-		}
+	// the response couldn't contains 'Content-Length: 0'
+	b := []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	if _, err = conn.Write(b); err != nil {
+		log.Printf(`[http] write reply failed: %s`, err)
+		return false
 	}
 
+	dash := dashOf(decision)
 	log.Printf(`[http] tunnel established %s <%c> %s`, conn.RemoteAddr(), dash, addr)
-	if err := utils.Transport(conn, nextHop); err != nil {
+	t := &tunnel.Tunnel{
+		Command:     "connect",
+		User:        user,
+		Source:      conn.RemoteAddr().String(),
+		Destination: addr,
+		Rule:        decision,
+	}
+	if err := c.transport(t, conn, nextHop); err != nil {
 		log.Printf(`[http] transport failed: %s`, err)
 	}
 	log.Printf(`[http] tunnel disconnected %s >%c< %s`, conn.RemoteAddr(), dash, addr)
+	return false
+}
+
+// dashOf returns the dash in logs of tunnels, '=' for direct ones
+func dashOf(decision string) rune {
+	if decision == decisionDirect {
+		return '='
+	}
+	return '-'
 }
 
 type httpWrapper struct {
 	net.Conn
-	client     *Client
+	upstream   *Upstream
 	body       io.ReadCloser
 	sentHeader bool
 
@@ -169,18 +180,17 @@ type httpWrapper struct {
 	auth  string
 }
 
-func newHTTPWrapper(conn net.Conn, client *Client) *httpWrapper {
+func newHTTPWrapper(conn net.Conn, upstream *Upstream) *httpWrapper {
 	var auth string
-	cfg := client.Config
-	if cfg.Username != "" && cfg.Password != "" {
-		s := base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + cfg.Password))
+	if upstream.Username != "" && upstream.Password != "" {
+		s := base64.StdEncoding.EncodeToString([]byte(upstream.Username + ":" + upstream.Password))
 		auth = "Basic " + s
 	}
 	return &httpWrapper{
-		Conn:   conn,
-		client: client,
-		ioBuf:  bufio.NewReader(conn),
-		auth:   auth,
+		Conn:     conn,
+		upstream: upstream,
+		ioBuf:    bufio.NewReader(conn),
+		auth:     auth,
 	}
 }
 
@@ -215,10 +225,10 @@ func (h *httpWrapper) Write(b []byte) (n int, err error) {
 	buf := bytes.NewBuffer(nil)
 	if !h.sentHeader {
 		buf.WriteString("POST ")
-		buf.WriteString(h.client.Config.HTTPPath)
+		buf.WriteString(h.upstream.HTTPPath)
 		buf.WriteString(" HTTP/1.1\r\n")
 		buf.WriteString("Host: ")
-		host, _, _ := net.SplitHostPort(h.client.Config.ServerAddr)
+		host, _, _ := net.SplitHostPort(h.upstream.Addr)
 		buf.WriteString(host)
 		buf.WriteString("\r\n")
 		if h.auth != "" {
@@ -3,10 +3,14 @@ package client
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/luyuhuang/subsocks/utils"
 )
@@ -26,10 +30,9 @@ func TestHTTPWrapper(t *testing.T) {
 		addr, _ := net.ResolveIPAddr("tcp", "127.0.0.1:1030")
 		conn := utils.NewFakeConn(addr, addr)
 
-		cli := NewClient("127.0.0.1:1030")
-		cli.Config.HTTPPath = c.path
+		upstream := &Upstream{Addr: "127.0.0.1:1080", HTTPPath: c.path}
 
-		wrapper := newHTTPWrapper(conn, cli)
+		wrapper := newHTTPWrapper(conn, upstream)
 		for _, datum := range c.data {
 			wrapper.Write([]byte(datum))
 		}
@@ -72,3 +75,157 @@ func TestHTTPWrapper(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPForward(t *testing.T) {
+	var conns int32
+	newServer := func(name string) *httptest.Server {
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.RequestURI != "/path?q=1" || r.Header.Get("Proxy-Connection") != "" || r.Header.Get("X-Hop") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Keep-Alive", "timeout=5")
+			fmt.Fprint(w, name)
+		}))
+		s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		}
+		s.Start()
+		return s
+	}
+	s1, s2 := newServer("s1"), newServer("s2")
+	defer s1.Close()
+	defer s2.Close()
+
+	cli := NewClient("127.0.0.1:1080")
+	var err error
+	cli.Rules, err = NewRulesFromMap(map[string]string{"*": "D"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go cli.httpHandler(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// requests on the same connection go to their own hosts
+	for _, s := range []struct {
+		server *httptest.Server
+		body   string
+	}{{s1, "s1"}, {s2, "s2"}, {s1, "s1"}, {s2, "s2"}} {
+		fmt.Fprintf(conn, "GET %s/path?q=1 HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\nConnection: X-Hop\r\nX-Hop: 1\r\n\r\n",
+			s.server.URL, s.server.Listener.Addr())
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Read response failed: %s", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != s.body {
+			t.Fatalf("Response got %d %q, want 200 %q", res.StatusCode, body, s.body)
+		}
+		if res.Close || res.Header.Get("Keep-Alive") != "" {
+			t.Fatalf("Response should be kept alive without hop-by-hop headers")
+		}
+	}
+
+	// upstream connections are reused
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Fatalf("Upstream connections got %d, want 2", n)
+	}
+}
+
+func TestHTTPForwardContinue(t *testing.T) {
+	var conns int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// reading the body sends 100 Continue
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	}))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	cli := NewClient("127.0.0.1:1080")
+	var err error
+	cli.Rules, err = NewRulesFromMap(map[string]string{"*": "D"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go cli.httpHandler(conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+
+	host := s.Listener.Addr().String()
+	fmt.Fprintf(conn, "POST %s/ HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello", s.URL, host)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Read response failed: %s", err)
+	}
+	if res.StatusCode != http.StatusContinue {
+		t.Fatalf("Status got %d, want 100", res.StatusCode)
+	}
+
+	// the final response follows the interim one, and the next request on
+	// the same connection gets its own response
+	for _, want := range []string{"POST hello", "GET "} {
+		if want == "GET " {
+			fmt.Fprintf(conn, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", s.URL, host)
+		}
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("Read response failed: %s", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || string(body) != want {
+			t.Fatalf("Response got %d %q, want 200 %q", res.StatusCode, body, want)
+		}
+	}
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Upstream connections got %d, want 1", n)
+	}
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+const (
+	// httpIdleTimeout is how long an idle upstream connection is kept
+	httpIdleTimeout = 90 * time.Second
+	// httpMaxIdleConns is the most idle upstream connections kept for
+	// each destination
+	httpMaxIdleConns = 4
+)
+
+// hopHeaders are hop-by-hop headers, which aren't forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpConn is an upstream connection of plain HTTP requests
+type httpConn struct {
+	net.Conn
+	br       *bufio.Reader
+	decision string
+	idle     time.Time
+}
+
+// httpPool keeps idle upstream connections of plain HTTP requests by
+// destinations and their rules
+type httpPool struct {
+	mu    sync.Mutex
+	conns map[string][]*httpConn
+}
+
+func newHTTPPool() *httpPool {
+	return &httpPool{conns: make(map[string][]*httpConn)}
+}
+
+// get returns the latest idle connection to the destination, nil if
+// there's none
+func (p *httpPool) get(key string) *httpConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.conns[key]
+	for len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(conn.idle) < httpIdleTimeout {
+			p.set(key, conns)
+			return conn
+		}
+		conn.Close()
+	}
+	p.set(key, conns)
+	return nil
+}
+
+// put keeps the connection unless there are too many ones
+func (p *httpPool) put(key string, conn *httpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.conns[key]) >= httpMaxIdleConns {
+		conn.Close()
+		return
+	}
+	conn.idle = time.Now()
+	p.conns[key] = append(p.conns[key], conn)
+	time.AfterFunc(httpIdleTimeout, p.closeIdle)
+}
+
+// closeIdle closes connections idle for too long
+func (p *httpPool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conns := range p.conns {
+		var alive []*httpConn
+		for _, conn := range conns {
+			if time.Since(conn.idle) < httpIdleTimeout {
+				alive = append(alive, conn)
+			} else {
+				conn.Close()
+			}
+		}
+		p.set(key, alive)
+	}
+}
+
+func (p *httpPool) set(key string, conns []*httpConn) {
+	if len(conns) == 0 {
+		delete(p.conns, key)
+	} else {
+		p.conns[key] = conns
+	}
+}
+
+// forwardHTTP forwards a plain HTTP request to addr in origin-form, each
+// request is routed by the rules. It returns whether the client connection
+// can serve the next request.
+func (c *Client) forwardHTTP(conn net.Conn, req *http.Request, addr *socks.Addr, user string) bool {
+	upgrade := ""
+	if headerHasToken(req.Header, "Connection", "upgrade") {
+		upgrade = req.Header.Get("Upgrade")
+	}
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// don't let the default one be written
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	key := addr.String() + " " + strconv.Itoa(c.Rules.getRule(addr.Host, int(addr.Port)))
+	ser := c.httpConns.get(key)
+	for {
+		reused := ser != nil
+		if !reused {
+			nextHop, decision, err := c.dialTarget("http", addr, addr.Host, conn.RemoteAddr())
+			if err == errRejected {
+				httpReply(http.StatusForbidden, "").Write(conn)
+				return false
+			} else if err != nil {
+				log.Printf(`[http] %s`, err)
+				httpReply(http.StatusServiceUnavailable, "").Write(conn)
+				return false
+			}
+			ser = &httpConn{Conn: nextHop, br: bufio.NewReader(nextHop), decision: decision}
+		}
+
+		keep, err := c.exchangeHTTP(conn, ser, req, addr.String(), user, upgrade != "")
+		if err == nil {
+			if keep.upstream {
+				c.httpConns.put(key, ser)
+			} else {
+				ser.Close()
+			}
+			return keep.client
+		}
+		ser.Close()
+
+		// the idle connection may be closed by the peer, retry with a new
+		// one if the request has no body to send again
+		if reused && !keep.responded && req.Body == http.NoBody {
+			ser = nil
+			continue
+		}
+		log.Printf(`[http] forward request to %s failed: %s`, addr, err)
+		if !keep.responded {
+			httpReply(http.StatusBadGateway, "").Write(conn)
+		}
+		return false
+	}
+}
+
+// httpKeep tells whether connections of an exchange can be kept
+type httpKeep struct {
+	client    bool
+	upstream  bool
+	responded bool // whether anything is written to the client
+}
+
+// exchangeHTTP sends the request to ser and relays the response. If the
+// response switches protocols, the connections are tunneled.
+func (c *Client) exchangeHTTP(conn net.Conn, ser *httpConn, req *http.Request, addr, user string, upgrade bool) (keep httpKeep, err error) {
+	t := &tunnel.Tunnel{
+		Command:     "connect",
+		User:        user,
+		Source:      conn.RemoteAddr().String(),
+		Destination: addr,
+		Rule:        ser.decision,
+	}
+	dash := dashOf(ser.decision)
+	log.Printf(`[http] %s <%c> %s %s %s`, conn.RemoteAddr(), dash, addr, req.Method, req.URL.Path)
+
+	c.openTunnel(t, conn, ser)
+	defer c.closeTunnel(t)
+
+	if err = req.Write(&countWriter{ser, func(n int) { countUp(t, n) }}); err != nil {
+		return
+	}
+	res, err := http.ReadResponse(ser.br, req)
+	for err == nil && isInterim(res.StatusCode) {
+		// interim responses such as 100 Continue are relayed, the final one
+		// follows
+		keep.responded = true
+		if err = writeInterim(&countWriter{conn, func(n int) { countDown(t, n) }}, res); err != nil {
+			return
+		}
+		res, err = http.ReadResponse(ser.br, req)
+	}
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if upgrade && res.StatusCode == http.StatusSwitchingProtocols {
+		keep.responded = true
+		if err = res.Write(conn); err != nil {
+			return
+		}
+		log.Printf(`[http] tunnel established %s <%c> %s`, conn.RemoteAddr(), dash, addr)
+		if err := utils.TransportCount(conn, &bufferedConn{ser, ser.br},
+			func(n int) { countUp(t, n) },
+			func(n int) { countDown(t, n) }); err != nil {
+			log.Printf(`[http] transport failed: %s`, err)
+		}
+		log.Printf(`[http] tunnel disconnected %s >%c< %s`, conn.RemoteAddr(), dash, addr)
+		return keep, nil
+	}
+
+	keep.upstream = !res.Close
+	removeHopHeaders(res.Header)
+
+	// the client connection is kept regardless of the upstream one. A body
+	// without the length is chunked for HTTP/1.1 clients, otherwise the end
+	// of the body is the end of the connection.
+	res.Close = req.Close
+	res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.1", 1, 1
+	if res.ContentLength < 0 && !isChunked(res.TransferEncoding) && res.Body != http.NoBody {
+		if req.ProtoAtLeast(1, 1) {
+			res.TransferEncoding = []string{"chunked"}
+		} else {
+			res.Close = true
+		}
+	}
+	keep.client = !res.Close
+
+	keep.responded = true
+	if err = res.Write(&countWriter{conn, func(n int) { countDown(t, n) }}); err != nil {
+		keep.client = false
+		keep.upstream = false
+		return keep, nil
+	}
+	return
+}
+
+// isInterim returns whether the status is of an interim response, 101 ends
+// the exchange, so it's not one
+func isInterim(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// writeInterim writes an interim response, which has no body
+func writeInterim(w io.Writer, res *http.Response) error {
+	removeHopHeaders(res.Header)
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", res.Status); err != nil {
+		return err
+	}
+	if err := res.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// removeHopHeaders removes hop-by-hop headers, including those listed in
+// the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// headerHasToken returns whether the comma-separated header contains the
+// token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+// countWriter counts bytes written to w
+type countWriter struct {
+	w     io.Writer
+	count func(int)
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.count(n)
+	return n, err
+}
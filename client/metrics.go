@@ -0,0 +1,55 @@
+package client
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/luyuhuang/subsocks/metrics"
+	"github.com/luyuhuang/subsocks/tunnel"
+)
+
+var registry = metrics.NewRegistry()
+
+var (
+	tunnelsActive = registry.NewGauge("subsocks_client_tunnels_active",
+		"Number of active tunnels.", "command")
+	tunnelsTotal = registry.NewCounter("subsocks_client_tunnels_total",
+		"Number of established tunnels.", "command")
+	transferredBytes = registry.NewCounter("subsocks_client_transferred_bytes_total",
+		"Bytes transferred through tunnels, up is from the peer that opens the tunnel to the target.", "direction")
+	dialFailures = registry.NewCounter("subsocks_client_dial_failures_total",
+		"Number of failed dials to servers or remote addresses.", "target", "reason")
+	authFailures = registry.NewCounter("subsocks_client_auth_failures_total",
+		"Number of failed authorizations of local users.", "protocol")
+	handshakeSeconds = registry.NewHistogram("subsocks_client_handshake_seconds",
+		"Time to connect and handshake with a server.", metrics.DefBuckets, "server")
+	ruleDecisions = registry.NewCounter("subsocks_client_rule_decisions_total",
+		"Number of connections routed by rules.", "decision")
+)
+
+// rule decisions
+const (
+	decisionProxy        = "proxy"
+	decisionDirect       = "direct"
+	decisionAutoFallback = "auto-fallback"
+	decisionReject       = "reject"
+)
+
+func (c *Client) serveMetrics(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	if err := http.Serve(listener, mux); err != nil {
+		log.Printf("Serve metrics failed: %s", err)
+	}
+}
+
+func countUp(t *tunnel.Tunnel, n int) {
+	transferredBytes.Add(float64(n), "up")
+	t.AddUp(n)
+}
+
+func countDown(t *tunnel.Tunnel, n int) {
+	transferredBytes.Add(float64(n), "down")
+	t.AddDown(n)
+}
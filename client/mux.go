@@ -0,0 +1,81 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/luyuhuang/subsocks/mux"
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func (c *Client) openStream(u *Upstream) (net.Conn, error) {
+	sess, err := c.getSession(u)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := sess.Open()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// getSession returns a session to the server that has room for a new
+// stream, creates one if there's none.
+func (c *Client) getSession(u *Upstream) (*mux.Session, error) {
+	u.muxMu.Lock()
+	defer u.muxMu.Unlock()
+
+	var sess *mux.Session
+	sessions := u.muxSessions[:0]
+	for _, s := range u.muxSessions {
+		if s.IsClosed() {
+			continue
+		}
+		sessions = append(sessions, s)
+		if sess == nil && (c.Config.MuxMaxStreams <= 0 || s.NumStreams() < c.Config.MuxMaxStreams) {
+			sess = s
+		}
+	}
+	u.muxSessions = sessions
+	if sess != nil {
+		return sess, nil
+	}
+
+	conn, err := dialUpstream(u, c.Config.ServerDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := socks.NewRequest(socks.CmdMux, nil).Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res, err := socks.ReadReply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.Rep != socks.Succeeded {
+		conn.Close()
+		return nil, fmt.Errorf("Request multiplexing failed: %q", res.Rep)
+	}
+
+	log.Printf("[mux] session established with %s", u)
+	sess = mux.Client(conn, c.muxConfig())
+	u.muxSessions = append(u.muxSessions, sess)
+	return sess, nil
+}
+
+// muxConfig returns the configuration of mux sessions
+func (c *Client) muxConfig() *mux.Config {
+	config := mux.DefaultConfig()
+	if c.Config.MuxKeepAliveInterval > 0 {
+		config.KeepAliveInterval = c.Config.MuxKeepAliveInterval
+	}
+	if c.Config.MuxKeepAliveTimeout > 0 {
+		config.KeepAliveTimeout = c.Config.MuxKeepAliveTimeout
+	}
+	return config
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/luyuhuang/subsocks/trie"
+)
+
+// pacPath is where the HTTP listener serves the PAC script
+const pacPath = "/proxy.pac"
+
+// rules of PAC scripts, unknown means the PAC script can't decide and
+// leaves it to the client
+const (
+	pacUnknown = -1
+	pacNone    = 0
+	pacDirect  = 1
+	pacProxy   = 2
+)
+
+// pacScript finds rules compiled by compilePAC. Only direct rules return
+// DIRECT, others, including those it can't decide, go via the client.
+const pacScript = `
+var defaultPorts = {"http": 80, "ws": 80, "https": 443, "wss": 443, "ftp": 21};
+
+function getOwn(m, k) {
+	return Object.prototype.hasOwnProperty.call(m, k) ? m[k] : null;
+}
+
+function matchSet(s, host) {
+	var i, d;
+	if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+		for (i = 0; i < s.c.length; i++) {
+			if (isInNet(host, s.c[i].n, s.c[i].m)) {
+				return s.c[i].r;
+			}
+		}
+		return s.ui ? -1 : 0;
+	}
+	if (host.indexOf(":") >= 0) {
+		return s.v6 || s.ui ? -1 : 0;
+	}
+
+	d = getOwn(s.d, host);
+	if (d) {
+		return d[0];
+	}
+	for (i = host.indexOf("."); i >= 0; i = host.indexOf(".", i + 1)) {
+		d = getOwn(s.d, host.substring(i + 1));
+		if (d && d[1]) {
+			return d[0];
+		}
+	}
+	for (i = 0; i < s.k.length; i++) {
+		if (host.indexOf(s.k[i].k) >= 0) {
+			return s.k[i].r;
+		}
+	}
+	return s.ud ? -1 : 0;
+}
+
+function FindProxyForURL(url, host) {
+	var m = /^([a-z0-9+.-]+):\/\/(?:[^\/@]*@)?(\[[^\]]*\]|[^\/:]*)(?::(\d+))?/i.exec(url);
+	var port = 0, rule = 0, i;
+	if (m) {
+		port = m[3] ? parseInt(m[3], 10) : getOwn(defaultPorts, m[1].toLowerCase()) || 0;
+	}
+	if (ports.length > 0 && !port) {
+		return proxy;
+	}
+
+	for (i = 0; !rule && i < ports.length; i++) {
+		if (ports[i].lo <= port && port <= ports[i].hi) {
+			rule = matchSet(ports[i], host);
+		}
+	}
+	for (i = 0; !rule && i < ports.length; i++) {
+		if (ports[i].lo <= port && port <= ports[i].hi) {
+			rule = ports[i].o;
+		}
+	}
+	if (!rule) {
+		rule = matchSet(main, host);
+	}
+	if (!rule) {
+		rule = main.o;
+	}
+	return rule == 1 ? "DIRECT" : proxy;
+}
+`
+
+// pacSet is a rule set compiled for PAC scripts
+type pacSet struct {
+	Lo       int               `json:"lo,omitempty"`
+	Hi       int               `json:"hi,omitempty"`
+	Domains  map[string][2]int `json:"d"` // the rule and 1 if it's a wildcard
+	Keywords []pacKeyword      `json:"k"`
+	CIDRs    []pacCIDR         `json:"c"` // longer prefixes go first
+	Other    int               `json:"o"`
+
+	UnknownDomain bool `json:"ud"` // regexps or resolving make domains unknown
+	UnknownIP     bool `json:"ui"` // GEOIP rules make IPs unknown
+	IPv6          bool `json:"v6"` // IPv6 rules are unknown
+}
+
+type pacKeyword struct {
+	Keyword string `json:"k"`
+	Rule    int    `json:"r"`
+}
+
+type pacCIDR struct {
+	Net  string `json:"n"`
+	Mask string `json:"m"`
+	Rule int    `json:"r"`
+	ones int
+}
+
+// pacCache is the compiled rule set, it's compiled again once rules are
+// reloaded
+type pacCache struct {
+	mu   sync.Mutex
+	set  *ruleSet
+	data []byte
+}
+
+func pacRule(rule int) int {
+	switch rule {
+	case ruleNone:
+		return pacNone
+	case ruleDirect:
+		return pacDirect
+	}
+	return pacProxy
+}
+
+// compilePAC returns the definitions of main and ports in PAC scripts
+func (r *Rules) compilePAC() []byte {
+	if r == nil {
+		return []byte(`var main = {"d": {}, "k": [], "c": [], "o": 2};` + "\nvar ports = [];\n")
+	}
+
+	s := r.rules()
+	r.pac.mu.Lock()
+	defer r.pac.mu.Unlock()
+	if r.pac.set == s {
+		return r.pac.data
+	}
+
+	ports := make([]*pacSet, 0, len(s.ports))
+	for _, p := range s.ports {
+		ports = append(ports, r.compilePACSet(p.ruleSet, p.lo, p.hi))
+	}
+	main, _ := json.Marshal(r.compilePACSet(s, 0, 0))
+	portsData, _ := json.Marshal(ports)
+
+	var buf bytes.Buffer
+	buf.WriteString("var main = ")
+	buf.Write(main)
+	buf.WriteString(";\nvar ports = ")
+	buf.Write(portsData)
+	buf.WriteString(";\n")
+
+	r.pac.set, r.pac.data = s, buf.Bytes()
+	return r.pac.data
+}
+
+func (r *Rules) compilePACSet(s *ruleSet, lo, hi int) *pacSet {
+	p := &pacSet{
+		Lo:       lo,
+		Hi:       hi,
+		Domains:  make(map[string][2]int),
+		Keywords: []pacKeyword{},
+		CIDRs:    []pacCIDR{},
+		Other:    pacRule(s.other),
+	}
+
+	var walkDomain func(n *trie.DomainNode, name string)
+	walkDomain = func(n *trie.DomainNode, name string) {
+		if n.Rule != ruleNone {
+			wild := 0
+			if n.Wild {
+				wild = 1
+			}
+			p.Domains[name] = [2]int{pacRule(n.Rule), wild}
+		}
+		for label, child := range n.Children {
+			if name == "" {
+				walkDomain(child, label)
+			} else {
+				walkDomain(child, label+"."+name)
+			}
+		}
+	}
+	walkDomain(s.tree.Domains, "")
+
+	for _, k := range s.keywords {
+		p.Keywords = append(p.Keywords, pacKeyword{k.keyword, pacRule(k.rule)})
+	}
+
+	var walkIP func(n *trie.IPNode, bits []byte)
+	walkIP = func(n *trie.IPNode, bits []byte) {
+		if n == nil {
+			return
+		}
+		bits = append(bits[:len(bits):len(bits)], n.Bits...)
+		if n.Rule != ruleNone {
+			ip := make(net.IP, net.IPv4len)
+			for i, b := range bits {
+				ip[i/8] |= b << (7 - i%8)
+			}
+			mask := net.IP(net.CIDRMask(len(bits), 32))
+			p.CIDRs = append(p.CIDRs, pacCIDR{ip.String(), mask.String(), pacRule(n.Rule), len(bits)})
+		}
+		walkIP(n.Children[0], bits)
+		walkIP(n.Children[1], bits)
+	}
+	walkIP(s.tree.IPv4, nil)
+	sort.SliceStable(p.CIDRs, func(i, j int) bool {
+		return p.CIDRs[i].ones > p.CIDRs[j].ones
+	})
+
+	p.UnknownDomain = len(s.regexps) > 0 || r.geoIP != nil && r.geoIP.resolve
+	p.UnknownIP = r.geoIP != nil && len(s.geoRules) > 0
+	p.IPv6 = s.tree.IPv6.Rule != ruleNone || s.tree.IPv6.Children[0] != nil || s.tree.IPv6.Children[1] != nil
+	return p
+}
+
+// servePAC replies the PAC script, in which proxies are the address the
+// request is sent to
+func (c *Client) servePAC(conn net.Conn) {
+	addr := conn.LocalAddr().String()
+	proxy := "SOCKS5 " + addr + "; PROXY " + addr
+	if c.Config.Verify != nil {
+		// browsers don't support socks5 authorization
+		proxy = "PROXY " + addr
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("var proxy = " + strconv.Quote(proxy) + ";\n")
+	buf.Write(c.Rules.compilePAC())
+	buf.WriteString(pacScript)
+
+	log.Printf("[http] serve PAC for %s", conn.RemoteAddr())
+	reply := httpReply(http.StatusOK, "")
+	reply.Header = make(http.Header)
+	reply.Header.Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	reply.ContentLength = int64(buf.Len())
+	reply.Body = ioutil.NopCloser(&buf)
+	reply.Write(conn)
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+func TestServePAC(t *testing.T) {
+	cli := NewClient("127.0.0.1:1080")
+	var err error
+	cli.Rules, err = NewRulesFromMap(map[string]string{
+		"*.google.com":      "D",
+		"10.0.0.0/8":        "D",
+		"*.example.com:443": "R",
+		"*":                 "P",
+	})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	local, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1080")
+	remote, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:50000")
+	conn := utils.NewFakeConn(local, remote)
+	conn.In.WriteString("GET /proxy.pac HTTP/1.1\r\nHost: 127.0.0.1:1080\r\n\r\n")
+	cli.httpHandler(conn)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn.Out), nil)
+	if err != nil {
+		t.Fatalf("Read response failed: %s", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Status got %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	if typ := res.Header.Get("Content-Type"); typ != "application/x-ns-proxy-autoconfig" {
+		t.Fatalf("Content type got %q", typ)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	script := string(body)
+	for _, s := range []string{
+		`var proxy = "SOCKS5 127.0.0.1:1080; PROXY 127.0.0.1:1080";`,
+		`"google.com":[1,1]`,
+		`{"n":"10.0.0.0","m":"255.0.0.0","r":1}`,
+		`{"lo":443,"hi":443,"d":{"example.com":[2,1]}`,
+		"function FindProxyForURL(url, host)",
+	} {
+		if !strings.Contains(script, s) {
+			t.Fatalf("PAC script doesn't contain %s:\n%s", s, script)
+		}
+	}
+
+	// it's compiled again once rules are reloaded
+	data := cli.Rules.compilePAC()
+	if &cli.Rules.compilePAC()[0] != &data[0] {
+		t.Fatalf("PAC should be cached")
+	}
+	s, _ := cli.Rules.build()
+	s.setRule("*", ruleDirect)
+	cli.Rules.ruleMu.Lock()
+	cli.Rules.ruleSet = s
+	cli.Rules.ruleMu.Unlock()
+	if data := string(cli.Rules.compilePAC()); !strings.Contains(data, `"o":1`) {
+		t.Fatalf("PAC isn't compiled again: %s", data)
+	}
+}
+
+func TestServePACAuth(t *testing.T) {
+	cli := NewClient("127.0.0.1:1080")
+	cli.Config.Verify = utils.VerifyByMap(map[string]string{"admin": "123456"})
+	var err error
+	cli.Rules, err = NewRulesFromMap(map[string]string{"*": "P"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	cases := []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Authorization: Basic YWRtaW46YWJjZGVm\r\n", http.StatusUnauthorized}, // admin:abcdef
+		{"Authorization: Basic YWRtaW46MTIzNDU2\r\n", http.StatusOK},           // admin:123456
+		{"Proxy-Authorization: Basic YWRtaW46MTIzNDU2\r\n", http.StatusOK},
+	}
+
+	local, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1080")
+	remote, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:50000")
+	for _, c := range cases {
+		conn := utils.NewFakeConn(local, remote)
+		conn.In.WriteString("GET /proxy.pac HTTP/1.1\r\nHost: 127.0.0.1:1080\r\n" + c.header + "\r\n")
+		cli.httpHandler(conn)
+
+		res, err := http.ReadResponse(bufio.NewReader(conn.Out), nil)
+		if err != nil {
+			t.Fatalf("Read response failed: %s", err)
+		}
+		if res.StatusCode != c.status {
+			t.Fatalf("Status with %q got %d, want %d", c.header, res.StatusCode, c.status)
+		}
+		if c.status == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("WWW-Authenticate is missing")
+		}
+	}
+}
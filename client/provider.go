@@ -0,0 +1,219 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+)
+
+// Provider is a rule list in another format, all of its entries get the
+// same rule
+type Provider struct {
+	Path   string
+	Format string // gfwlist or clash
+	Rule   string
+}
+
+type provider struct {
+	*Provider
+	rule int
+}
+
+// AddProvider loads the provider and watches it. For the same address,
+// rules win over providers, and providers added earlier win over later
+// ones. It should be called before serving.
+func (r *Rules) AddProvider(p *Provider) error {
+	rule := r.parseRule(p.Rule)
+	if rule == ruleNone {
+		return fmt.Errorf("Rule of provider %s got %s, want %s", p.Path, p.Rule, r.ruleNames())
+	}
+	if p.Format != "gfwlist" && p.Format != "clash" {
+		return fmt.Errorf("Format of provider %s got %q, want gfwlist|clash", p.Path, p.Format)
+	}
+
+	r.buildMu.Lock()
+	r.providers = append(r.providers, &provider{p, rule})
+	err := r.rebuild()
+	if err != nil {
+		r.providers = r.providers[:len(r.providers)-1]
+	}
+	r.buildMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	r.watch(p.Path)
+	return nil
+}
+
+// load sets entries of the provider to s
+func (p *provider) load(s *ruleSet) error {
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return fmt.Errorf("Load provider failed: %s", err)
+	}
+
+	var loaded, skipped int
+	switch p.Format {
+	case "gfwlist":
+		loaded, skipped = loadGFWList(s, data, p.rule)
+	case "clash":
+		loaded, skipped = loadClash(s, data, p.rule)
+	}
+	log.Printf("[rules] load %d entries from %s, %d unsupported ones are skipped", loaded, p.Path, skipped)
+	return nil
+}
+
+// loadGFWList loads an AdBlock-style list, which may be base64 encoded.
+// Entries are mapped to domain rules: "||host" and ".host" are the host and
+// its subdomains, "|http://host/" is the host only, and exceptions starting
+// with "@@" go directly. Regular expressions are not supported.
+func loadGFWList(s *ruleSet, data []byte, rule int) (loaded, skipped int) {
+	if b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), "")); err == nil {
+		data = b
+	}
+
+	// exceptions are set at last to win over blocked entries
+	var blocked, exceptions []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		exception := strings.HasPrefix(line, "@@")
+		if exception {
+			line = line[2:]
+		}
+
+		var addr string
+		switch {
+		case strings.HasPrefix(line, "/"):
+		case strings.HasPrefix(line, "||"):
+			addr = wildcardAddr(gfwHost(line[2:]))
+		case strings.HasPrefix(line, "|"):
+			addr = gfwHost(line[1:])
+		case strings.HasPrefix(line, "."):
+			addr = wildcardAddr(gfwHost(line[1:]))
+		case strings.Contains(line, "."):
+			// a plain pattern matches any part of URLs, only those look
+			// like a domain are taken
+			addr = wildcardAddr(gfwHost(line))
+		}
+		if addr == "" {
+			skipped++
+		} else if exception {
+			exceptions = append(exceptions, addr)
+		} else {
+			blocked = append(blocked, addr)
+		}
+	}
+
+	for _, addr := range blocked {
+		s.setRule(addr, rule)
+	}
+	for _, addr := range exceptions {
+		s.setRule(addr, ruleDirect)
+	}
+	return len(blocked) + len(exceptions), skipped
+}
+
+// gfwHost extracts the host of a gfwlist pattern, empty if there's none
+func gfwHost(pattern string) string {
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		pattern = pattern[i+3:]
+	}
+	pattern = strings.TrimPrefix(pattern, "*.")
+	if i := strings.IndexAny(pattern, "/:^?*|"); i >= 0 {
+		pattern = pattern[:i]
+	}
+
+	if net.ParseIP(pattern) != nil {
+		return pattern
+	}
+	return validDomain(pattern)
+}
+
+// wildcardAddr returns the rule address of host and its subdomains
+func wildcardAddr(host string) string {
+	if host == "" || net.ParseIP(host) != nil {
+		return host
+	}
+	return "*." + host
+}
+
+// loadClash loads a Clash rule provider, of the classical, domain or
+// ipcidr behavior. The YAML payload is read line by line, and classical
+// entries of DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-CIDR, IP-CIDR6 and
+// GEOIP are supported.
+func loadClash(s *ruleSet, data []byte, rule int) (loaded, skipped int) {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line == "payload:" {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "-"))
+		line = strings.Trim(line, `'"`)
+		if line == "" {
+			continue
+		}
+
+		if setClashRule(s, line, rule) {
+			loaded++
+		} else {
+			skipped++
+		}
+	}
+	return
+}
+
+// setClashRule sets the rule of a Clash entry, it returns false if the
+// entry is not supported
+func setClashRule(s *ruleSet, entry string, rule int) bool {
+	fields := strings.Split(entry, ",")
+	if len(fields) == 1 {
+		// an entry of the domain or ipcidr behavior
+		if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+			return s.setRule(entry, rule) == nil
+		}
+		for _, prefix := range []string{"+.", "*.", "."} {
+			if strings.HasPrefix(entry, prefix) {
+				return setDomain(s, wildcardAddr(validDomain(entry[len(prefix):])), rule)
+			}
+		}
+		return setDomain(s, validDomain(entry), rule)
+	}
+
+	value := strings.TrimSpace(fields[1])
+	switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+	case "DOMAIN":
+		return setDomain(s, validDomain(value), rule)
+	case "DOMAIN-SUFFIX":
+		return setDomain(s, wildcardAddr(validDomain(value)), rule)
+	case "DOMAIN-KEYWORD":
+		if value == "" {
+			return false
+		}
+		s.setKeyword(strings.ToLower(value), rule)
+		return true
+	case "IP-CIDR", "IP-CIDR6":
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return false
+		}
+		return s.setRule(value, rule) == nil
+	case "GEOIP":
+		if value == "" {
+			return false
+		}
+		return s.setRule(geoIPPrefix+value, rule) == nil
+	}
+	return false
+}
+
+// setDomain sets the rule of a domain address, empty means it's invalid
+func setDomain(s *ruleSet, addr string, rule int) bool {
+	return addr != "" && s.setRule(addr, rule) == nil
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const gfwList = `[AutoProxy 0.2.9]
+! comment
+||google.com
+|http://85.17.73.31/
+|https://www.example.org/path
+.twitter.com
+blogspot.com/path
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+@@||mail.google.com
+@@||example.net
+||example.net
+||*
+||localhost
+keyword
+`
+
+const clashRules = `payload:
+  # comment
+  - DOMAIN,exact.example.com
+  - DOMAIN-SUFFIX,netflix.com
+  - 'DOMAIN-KEYWORD,tube'
+  - IP-CIDR,1.2.3.0/24,no-resolve
+  - IP-CIDR6,2001:db8::/32
+  - PROCESS-NAME,curl
+  - "+.bing.com"
+  - 5.6.7.0/24
+`
+
+func writeProvider(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Write provider failed: %s", err)
+	}
+	return path
+}
+
+func checkRules(t *testing.T, r *Rules, cases map[string]int) {
+	for addr, want := range cases {
+		if rule := r.getRule(addr, 0); rule != want {
+			t.Fatalf("Rule of %s got %d, want %d", addr, rule, want)
+		}
+	}
+}
+
+func TestProviderGFWList(t *testing.T) {
+	r, err := NewRulesFromMap(map[string]string{"*": "A"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(gfwList))
+	path := writeProvider(t, "gfwlist.txt", encoded)
+	if err := r.AddProvider(&Provider{Path: path, Format: "gfwlist", Rule: "P"}); err != nil {
+		t.Fatalf("Add provider failed: %s", err)
+	}
+
+	checkRules(t, r, map[string]int{
+		"google.com":          ruleProxy,
+		"www.google.com":      ruleProxy,
+		"mail.google.com":     ruleDirect,
+		"85.17.73.31":         ruleProxy,
+		"www.example.org":     ruleProxy,
+		"a.www.example.org":   ruleAuto,
+		"twitter.com":         ruleProxy,
+		"api.twitter.com":     ruleProxy,
+		"blogspot.com":        ruleProxy,
+		"example.net":         ruleDirect,
+		"www.example.net":     ruleDirect,
+		"www.example.com":     ruleAuto,
+		"mail.google.com.org": ruleAuto,
+		"localhost":           ruleProxy,
+		"keyword":             ruleAuto,
+	})
+}
+
+func TestProviderClash(t *testing.T) {
+	r, err := NewRulesFromMap(map[string]string{"*": "A"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	path := writeProvider(t, "rules.yaml", clashRules)
+	if err := r.AddProvider(&Provider{Path: path, Format: "clash", Rule: "D"}); err != nil {
+		t.Fatalf("Add provider failed: %s", err)
+	}
+
+	checkRules(t, r, map[string]int{
+		"exact.example.com":   ruleDirect,
+		"a.exact.example.com": ruleAuto,
+		"netflix.com":         ruleDirect,
+		"www.netflix.com":     ruleDirect,
+		"www.youtube.com":     ruleDirect,
+		"1.2.3.4":             ruleDirect,
+		"2001:db8::1":         ruleDirect,
+		"bing.com":            ruleDirect,
+		"cn.bing.com":         ruleDirect,
+		"5.6.7.8":             ruleDirect,
+		"5.6.8.8":             ruleAuto,
+		"curl":                ruleAuto,
+	})
+}
+
+func TestProviderPrecedence(t *testing.T) {
+	r, err := NewRulesFromMap(map[string]string{
+		"*.google.com": "D",
+		"*":            "A",
+	})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	first := writeProvider(t, "first.yaml", "payload:\n  - DOMAIN-SUFFIX,google.com\n  - DOMAIN-SUFFIX,github.com\n  - DOMAIN-KEYWORD,tube\n")
+	second := writeProvider(t, "second.txt", "||github.com\n||youtube.com\n||example.com\n")
+	if err := r.AddProvider(&Provider{Path: first, Format: "clash", Rule: "R"}); err != nil {
+		t.Fatalf("Add provider failed: %s", err)
+	}
+	if err := r.AddProvider(&Provider{Path: second, Format: "gfwlist", Rule: "P"}); err != nil {
+		t.Fatalf("Add provider failed: %s", err)
+	}
+
+	checkRules(t, r, map[string]int{
+		"www.google.com":  ruleDirect, // rules win
+		"github.com":      ruleReject, // the first provider wins
+		"youtube.com":     ruleProxy,  // domains win over keywords
+		"tube.com":        ruleReject,
+		"www.example.com": ruleProxy,
+		"example.org":     ruleAuto,
+	})
+
+	// the provider is reloaded once it's written
+	if err := ioutil.WriteFile(second, []byte("||example.org\n"), 0644); err != nil {
+		t.Fatalf("Write provider failed: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.getRule("example.org", 0) != ruleProxy {
+		if time.Now().After(deadline) {
+			t.Fatalf("Provider isn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkRules(t, r, map[string]int{
+		"www.example.com": ruleAuto,
+		"github.com":      ruleReject,
+	})
+}
+
+func TestProviderIllegal(t *testing.T) {
+	r, err := NewRulesFromMap(map[string]string{"*": "A"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	path := writeProvider(t, "rules.yaml", clashRules)
+
+	if err := r.AddProvider(&Provider{Path: path, Format: "clash", Rule: "x"}); err == nil {
+		t.Fatalf("Illegal rule should fail")
+	}
+	if err := r.AddProvider(&Provider{Path: path, Format: "surge", Rule: "P"}); err == nil {
+		t.Fatalf("Illegal format should fail")
+	}
+	if err := r.AddProvider(&Provider{Path: path + ".none", Format: "clash", Rule: "P"}); err == nil {
+		t.Fatalf("Missing file should fail")
+	}
+	if len(r.providers) != 0 {
+		t.Fatalf("Providers got %d, want 0", len(r.providers))
+	}
+}
+
+func TestProviderReload(t *testing.T) {
+	rulesPath := writeProvider(t, "rules.txt", "* A\n")
+	r, err := NewRulesFromFile(rulesPath)
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	// providers are added while the rule file reloads
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			ioutil.WriteFile(rulesPath, []byte("* A\n"), 0644)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		path := writeProvider(t, "clash.yaml", clashRules)
+		if err := r.AddProvider(&Provider{Path: path, Format: "clash", Rule: "P"}); err != nil {
+			t.Fatalf("Add provider failed: %s", err)
+		}
+	}
+	<-done
+
+	checkRules(t, r, map[string]int{
+		"www.netflix.com": ruleProxy,
+		"www.example.com": ruleAuto,
+	})
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/luyuhuang/subsocks/quic"
+)
+
+// openQUICStream opens a tunnel as a stream of a QUIC connection to the
+// server, a new connection is made if the existing ones are full.
+func (u *Upstream) openQUICStream(timeout time.Duration) (net.Conn, error) {
+	u.quicMu.Lock()
+	defer u.quicMu.Unlock()
+
+	sessions := u.quicSessions[:0]
+	for _, s := range u.quicSessions {
+		if !s.IsClosed() {
+			sessions = append(sessions, s)
+		}
+	}
+	u.quicSessions = sessions
+	for _, s := range sessions {
+		if conn, err := s.Open(); err == nil {
+			return conn, nil
+		}
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	sess, err := quic.Dial(ctx, u.Addr, u.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[quic] connection established with %s", u)
+	u.quicSessions = append(u.quicSessions, sess)
+	return sess.Open()
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/luyuhuang/subsocks/mux"
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
+)
+
+const (
+	reverseMinBackoff = time.Second
+	reverseMaxBackoff = time.Minute
+)
+
+// Reverse asks the server to listen on a port, and relays connections to
+// that port to a local address
+type Reverse struct {
+	Port   int
+	Target string
+	Group  string
+}
+
+func (r *Reverse) String() string {
+	return fmt.Sprintf("server:%d", r.Port)
+}
+
+// serveReverse keeps the reverse tunnel registered, reconnecting if it's down
+func (c *Client) serveReverse(r *Reverse) {
+	backoff := reverseMinBackoff
+	for {
+		established, err := c.reverseTunnel(r)
+		if established {
+			backoff = reverseMinBackoff
+		}
+		log.Printf(`[reverse] tunnel %s closed: %s, reconnect in %s`, r, err, backoff)
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > reverseMaxBackoff {
+			backoff = reverseMaxBackoff
+		}
+	}
+}
+
+func (c *Client) reverseTunnel(r *Reverse) (bool, error) {
+	// the tunnel is a mux session itself, so it never takes a stream of
+	// another session
+	ser, err := c.dialGroupMux(r.Group, false)
+	if err != nil {
+		return false, err
+	}
+	defer ser.Close()
+
+	addr := socks.NewAddrFromPair("0.0.0.0", r.Port)
+	if err := socks.NewRequest(socks.CmdReverse, addr).Write(ser); err != nil {
+		return false, err
+	}
+	reply, err := socks.ReadReply(ser)
+	if err != nil {
+		return false, err
+	}
+	if reply.Rep != socks.Succeeded {
+		return false, fmt.Errorf("Server refused reverse tunnel, reply %d", reply.Rep)
+	}
+
+	log.Printf(`[reverse] tunnel established %s <-> %s`, reply.Addr, r.Target)
+	sess := mux.Server(ser, c.muxConfig())
+	defer sess.Close()
+
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return true, err
+		}
+		go c.reverseHandler(r, stream)
+	}
+}
+
+func (c *Client) reverseHandler(r *Reverse, stream net.Conn) {
+	defer stream.Close()
+
+	conn, err := c.dialDirect(r.Target)
+	if err != nil {
+		log.Printf(`[reverse] %s`, err)
+		return
+	}
+	defer conn.Close()
+
+	t := &tunnel.Tunnel{
+		Command:     "reverse",
+		Source:      r.String(),
+		Destination: r.Target,
+	}
+	if err := c.transport(t, stream, conn); err != nil {
+		log.Printf(`[reverse] transport failed: %s`, err)
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func TestReverseTunnelMux(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	cmds := make(chan uint8, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		socks.ReadMethods(conn)
+		socks.WriteMethod(socks.MethodNoAuth, conn)
+		req, err := socks.ReadRequest(conn)
+		if err != nil {
+			close(cmds)
+			return
+		}
+		cmds <- req.Cmd
+		socks.NewReply(socks.Allowed, nil).Write(conn)
+	}()
+
+	// the reverse tunnel isn't carried by a mux session even if it's on
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Mux = true
+	cli.Config.Servers = []*Upstream{{Protocol: "socks", Addr: ln.Addr().String()}}
+	if _, err := cli.reverseTunnel(&Reverse{Port: 2222, Target: "127.0.0.1:22"}); err == nil {
+		t.Fatalf("Reverse tunnel refused by the server succeeded")
+	}
+	if cmd := <-cmds; cmd != socks.CmdReverse {
+		t.Fatalf("Request command got %d, want %d", cmd, socks.CmdReverse)
+	}
+}
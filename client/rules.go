@@ -6,10 +6,15 @@ import (
 	"log"
 	"net"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/luyuhuang/subsocks/trie"
 )
 
 const (
@@ -17,119 +22,185 @@ const (
 	ruleProxy
 	ruleDirect
 	ruleAuto
+	ruleReject
 )
 
+// rules not less than ruleGroup proxy via the named group ruleGroup+i
+const ruleGroup = 64
+
 var ruleString2Rule = map[string]int{
 	"proxy":  ruleProxy,
 	"direct": ruleDirect,
 	"auto":   ruleAuto,
+	"reject": ruleReject,
 	"P":      ruleProxy,
 	"D":      ruleDirect,
 	"A":      ruleAuto,
+	"R":      ruleReject,
+}
+
+// ruleSet holds rules of all sources. It's rebuilt instead of modified
+// once a source changes.
+type ruleSet struct {
+	tree     *trie.Tree     // rules of IPs, CIDRs and domains
+	geoRules map[string]int // rules of country codes
+	keywords []keywordRule  // in order of precedence
+	regexps  []regexpRule   // in order of precedence
+	ports    []*portRules   // narrower ranges go first
+	other    int
+
+	domainsAllowed bool // some domain rules aren't rejects
 }
 
-type domainNode struct {
-	rule     int
-	wild     bool
-	children map[string]*domainNode
+// keywordRule is the rule of domains containing the keyword
+type keywordRule struct {
+	keyword string
+	rule    int
 }
 
-func newDomainNode() *domainNode {
-	return &domainNode{children: make(map[string]*domainNode)}
+// regexpRule is the rule of domains matching the expression
+type regexpRule struct {
+	re   *regexp.Regexp
+	rule int
 }
 
-type ipNode struct {
-	rule     int
-	bits     []byte
-	children [2]*ipNode
+// portRules are rules of destination ports from lo to hi, its other rule
+// applies to all addresses at the ports
+type portRules struct {
+	lo, hi int
+	*ruleSet
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		tree:     trie.New(),
+		geoRules: make(map[string]int),
+		other:    ruleAuto,
+	}
 }
 
+const (
+	// keywordPrefix starts rule addresses of keywords, e.g. "KEYWORD,google"
+	keywordPrefix = "KEYWORD,"
+	// regexpPrefix starts rule addresses of regular expressions, which
+	// match whole domains, e.g. "REGEXP,ads?\\.example\\.com"
+	regexpPrefix = "REGEXP,"
+)
+
 // Rules represents proxy rules
 type Rules struct {
-	domainTree *domainNode
-	ipv4Tree   *ipNode
-	ipv6Tree   *ipNode
-	other      int
+	*ruleSet
+	ruleMu sync.RWMutex
 
-	mu        sync.RWMutex
-	isProxy   map[string]bool
-	cacheFile *os.File
-
-	watcher   *fsnotify.Watcher
+	// buildMu guards sources of rules, so that they don't change while
+	// building
+	buildMu   sync.Mutex
+	rulesMap  map[string]string
 	rulesPath string
-	ruleMu    sync.RWMutex
+	providers []*provider
+	watcher   *fsnotify.Watcher
+
+	cache *autoCache
+	geoIP *geoIP
+	pac   pacCache
+
+	groups []string
 }
 
-func newRules() *Rules {
+func newRules(groups []string) *Rules {
 	return &Rules{
-		isProxy: make(map[string]bool),
+		cache:  newAutoCache(),
+		groups: groups,
 	}
 }
 
-// NewRulesFromMap creates a Rules object from a map
-func NewRulesFromMap(rules map[string]string) (*Rules, error) {
-	r := newRules()
-	if err := r.loadCache(); err != nil {
+// NewRulesFromMap creates a Rules object from a map, a rule may be the name
+// of one of the groups
+func NewRulesFromMap(rules map[string]string, groups ...string) (r *Rules, err error) {
+	r = newRules(groups)
+	r.rulesMap = rules
+	if r.ruleSet, err = r.build(); err != nil {
 		return nil, err
 	}
-
-	r.ipv4Tree = new(ipNode)
-	r.ipv6Tree = new(ipNode)
-	r.domainTree = newDomainNode()
-	r.other = ruleAuto
-
-	for addr, rules := range rules {
-		rule, ok := ruleString2Rule[rules]
-		if !ok {
-			return nil, fmt.Errorf("Rule of %q got %s, want proxy|direct|auto|P|D|A", addr, rules)
-		}
-
-		if err := setRule(r.ipv4Tree, r.ipv6Tree, r.domainTree, &r.other, addr, rule); err != nil {
-			return nil, fmt.Errorf("Set rule failed: %s", err)
-		}
-	}
 	return r, nil
 }
 
-// NewRulesFromFile creates a Rules object from a rule file
-func NewRulesFromFile(path string) (r *Rules, err error) {
-	r = newRules()
-	if err := r.loadCache(); err != nil {
+// NewRulesFromFile creates a Rules object from a rule file, a rule may be
+// the name of one of the groups
+func NewRulesFromFile(path string, groups ...string) (r *Rules, err error) {
+	r = newRules(groups)
+	r.rulesPath = path
+	if r.ruleSet, err = r.build(); err != nil {
 		return nil, err
 	}
+	r.watch(path)
+	return r, nil
+}
 
-	r.rulesPath = path
-	r.ipv4Tree, r.ipv6Tree, r.domainTree, r.other, err = scanRules(path)
+// rebuild builds rules and replaces the current ones, buildMu must be held
+func (r *Rules) rebuild() error {
+	s, err := r.build()
 	if err != nil {
-		return nil, err
+		return err
 	}
+	r.ruleMu.Lock()
+	r.ruleSet = s
+	r.ruleMu.Unlock()
+	return nil
+}
 
-	r.watcher, err = fsnotify.NewWatcher()
-	if err == nil {
-		err = r.watcher.Add(path)
+// build loads rules of all sources. Providers are loaded in reverse order
+// and the rules at last, so that for the same address, the rules win over
+// providers, and earlier providers win over later ones.
+func (r *Rules) build() (*ruleSet, error) {
+	s := newRuleSet()
+	for i := len(r.providers) - 1; i >= 0; i-- {
+		if err := r.providers[i].load(s); err != nil {
+			return nil, err
+		}
 	}
 
-	if err != nil {
-		log.Printf("Watch %s failed", path)
-	} else {
-		go r.watchRules()
+	if r.rulesPath != "" {
+		if err := r.scanRules(s, r.rulesPath); err != nil {
+			return nil, err
+		}
+		return s, nil
 	}
 
-	return r, nil
+	// rules set later take precedence over overlapping keywords and regular
+	// expressions, so they're set in a stable order where longer ones win
+	addrs := make([]string, 0, len(r.rulesMap))
+	for addr := range r.rulesMap {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if len(addrs[i]) != len(addrs[j]) {
+			return len(addrs[i]) < len(addrs[j])
+		}
+		return addrs[i] < addrs[j]
+	})
+
+	for _, addr := range addrs {
+		rules := r.rulesMap[addr]
+		rule := r.parseRule(rules)
+		if rule == ruleNone {
+			return nil, fmt.Errorf("Rule of %q got %s, want %s", addr, rules, r.ruleNames())
+		}
+
+		if err := s.setRule(addr, rule); err != nil {
+			return nil, fmt.Errorf("Set rule failed: %s", err)
+		}
+	}
+	return s, nil
 }
 
-func scanRules(path string) (ipv4Tree, ipv6Tree *ipNode, domainTree *domainNode, other int, err error) {
+func (r *Rules) scanRules(rs *ruleSet, path string) (err error) {
 	f, err := os.Open(path)
 	defer f.Close()
 	if err != nil {
 		return
 	}
 
-	ipv4Tree = new(ipNode)
-	ipv6Tree = new(ipNode)
-	domainTree = newDomainNode()
-	other = ruleAuto
-
 	ln := 1
 	var addr string
 	var rule int
@@ -138,6 +209,9 @@ func scanRules(path string) (ipv4Tree, ipv6Tree *ipNode, domainTree *domainNode,
 		if line == "" || line[0] == '#' {
 			continue
 		}
+		if f := strings.Fields(line); len(f) > 1 && f[0] == "port" {
+			line = "*:" + strings.TrimSpace(line[len(f[0]):])
+		}
 
 		if i := strings.IndexAny(line, " \t"); i < 0 {
 			if rule == ruleNone {
@@ -148,14 +222,14 @@ func scanRules(path string) (ipv4Tree, ipv6Tree *ipNode, domainTree *domainNode,
 		} else {
 			addr = line[:i]
 			rules := strings.TrimSpace(line[i+1:])
-			rule = ruleString2Rule[rules]
+			rule = r.parseRule(rules)
 			if rule == ruleNone {
-				err = fmt.Errorf("Rule in line %d got %s, want proxy|direct|auto|P|D|A", ln, rules)
+				err = fmt.Errorf("Rule in line %d got %s, want %s", ln, rules, r.ruleNames())
 				return
 			}
 		}
 
-		if err = setRule(ipv4Tree, ipv6Tree, domainTree, &other, addr, rule); err != nil {
+		if err = rs.setRule(addr, rule); err != nil {
 			err = fmt.Errorf("Set rule failed: %s", err)
 			return
 		}
@@ -164,235 +238,385 @@ func scanRules(path string) (ipv4Tree, ipv6Tree *ipNode, domainTree *domainNode,
 	return
 }
 
+// watch rebuilds rules once the file is written
+func (r *Rules) watch(path string) {
+	var err error
+	if r.watcher == nil {
+		r.watcher, err = fsnotify.NewWatcher()
+		if err == nil {
+			go r.watchRules()
+		}
+	}
+	if err == nil {
+		err = r.watcher.Add(path)
+	}
+
+	if err != nil {
+		log.Printf("Watch %s failed", path)
+	}
+}
+
 func (r *Rules) watchRules() {
 	for event := range r.watcher.Events {
 		if event.Op&fsnotify.Write != 0 {
-			log.Printf("Reload %s", r.rulesPath)
-			r.ruleMu.Lock()
-			ipv4Tree, ipv6Tree, domainTree, other, err := scanRules(r.rulesPath)
-			if err == nil {
-				r.ipv4Tree, r.ipv6Tree, r.domainTree, r.other = ipv4Tree, ipv6Tree, domainTree, other
-			} else {
+			log.Printf("Reload %s", event.Name)
+			r.buildMu.Lock()
+			if err := r.rebuild(); err != nil {
 				log.Println(err)
 			}
-			r.ruleMu.Unlock()
+			r.buildMu.Unlock()
 		}
 	}
 }
 
-func (r *Rules) loadCache() error {
-	f, err := os.OpenFile(".proxy-cache", os.O_CREATE|os.O_RDWR, 0664)
-	if err != nil {
-		return err
+// rules returns the current rule set
+func (r *Rules) rules() *ruleSet {
+	r.ruleMu.RLock()
+	defer r.ruleMu.RUnlock()
+	return r.ruleSet
+}
+
+func (r *Rules) parseRule(s string) int {
+	if rule, ok := ruleString2Rule[s]; ok {
+		return rule
+	}
+	for i, group := range r.groups {
+		if s == group {
+			return ruleGroup + i
+		}
 	}
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		r.isProxy[strings.TrimSpace(s.Text())] = true
+	return ruleNone
+}
+
+func (r *Rules) ruleNames() string {
+	names := append([]string{"proxy|direct|auto|reject|P|D|A|R"}, r.groups...)
+	return strings.Join(names, "|")
+}
+
+// groupOf returns the group a proxy rule uses, empty for the default one
+func (r *Rules) groupOf(rule int) string {
+	if r == nil || rule < ruleGroup {
+		return ""
 	}
-	r.cacheFile = f
+	return r.groups[rule-ruleGroup]
+}
 
-	return nil
+func isProxyRule(rule int) bool {
+	return rule == ruleProxy || rule >= ruleGroup
 }
 
-func setRule(ipv4Tree, ipv6Tree *ipNode, domainTree *domainNode, other *int, addr string, rule int) error {
-	if addr == "*" {
-		*other = rule
-	} else if ip := net.ParseIP(addr); ip != nil {
-		if ipv4 := ip.To4(); ipv4 != nil {
-			setIPRule(ipv4Tree, ipv4, 32, rule)
-		} else {
-			setIPRule(ipv6Tree, ip.To16(), 128, rule)
+// LoadCache loads the auto-proxy cache from the file and saves it there,
+// entries expire in ttl unless it's zero
+func (r *Rules) LoadCache(path string, ttl time.Duration) error {
+	return r.cache.load(path, ttl)
+}
+
+func (s *ruleSet) setRule(addr string, rule int) error {
+	if f := strings.Fields(addr); len(f) == 2 && f[0] == "port" {
+		addr = "*:" + f[1]
+	}
+
+	if host, lo, hi, ok := splitPortRule(addr); ok {
+		if lo == 0 {
+			return fmt.Errorf("Ports of %q are illegal", addr)
 		}
-	} else if _, cidr, err := net.ParseCIDR(addr); err == nil {
-		ones, _ := cidr.Mask.Size()
-		if ipv4 := cidr.IP.To4(); ipv4 != nil {
-			setIPRule(ipv4Tree, ipv4, ones, rule)
-		} else {
-			setIPRule(ipv6Tree, cidr.IP.To16(), ones, rule)
+		return s.portRules(lo, hi).setRule(host, rule)
+	}
+
+	if addr == "*" {
+		s.other = rule
+	} else if country, ok := parseGeoIPAddr(addr); ok {
+		s.geoRules[country] = rule
+	} else if keyword, ok := cutPrefixFold(addr, keywordPrefix); ok {
+		s.setKeyword(keyword, rule)
+	} else if expr, ok := cutPrefixFold(addr, regexpPrefix); ok {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return fmt.Errorf("Regexp %q is illegal: %s", expr, err)
 		}
+		s.regexps = append([]regexpRule{{re, rule}}, s.regexps...)
+		s.domainsAllowed = s.domainsAllowed || rule != ruleReject
 	} else {
-		if err := setDomainRule(domainTree, addr, rule); err != nil {
+		if err := s.tree.Set(addr, rule); err != nil {
 			return err
 		}
+		if net.ParseIP(addr) == nil && !strings.Contains(addr, "/") {
+			s.domainsAllowed = s.domainsAllowed || rule != ruleReject
+		}
 	}
 
 	return nil
 }
 
-func setIPRule(root *ipNode, ip []byte, length int, rule int) {
-	var p, pp *ipNode
-	p = root
-	j := 0
-	for i := 0; i < length; i++ {
-		b := (ip[i/8] >> (8 - i%8 - 1)) & 1
+// setKeyword sets the rule of domains containing the keyword, it takes
+// precedence over keywords set before
+func (s *ruleSet) setKeyword(keyword string, rule int) {
+	keywords := []keywordRule{{keyword, rule}}
+	for _, k := range s.keywords {
+		if k.keyword != keyword {
+			keywords = append(keywords, k)
+		}
+	}
+	s.keywords = keywords
+	s.domainsAllowed = s.domainsAllowed || rule != ruleReject
+}
 
-		if j >= len(p.bits) {
-			j = 0
-			pp = p
-			p = p.children[b]
+// portRules returns rules of ports from lo to hi, creating it if not exists
+func (s *ruleSet) portRules(lo, hi int) *ruleSet {
+	i := 0
+	for ; i < len(s.ports); i++ {
+		p := s.ports[i]
+		if p.lo == lo && p.hi == hi {
+			return p.ruleSet
 		}
+		if p.hi-p.lo > hi-lo {
+			break
+		}
+	}
 
-		var pnode, node *ipNode
-		if p == nil {
-			pnode = pp
-		} else if p.bits[j] != b {
-			// p: |------+---------|
-			//           ^ j
-			//    |--np--|----p----|
+	p := &portRules{lo, hi, newRuleSet()}
+	p.other = ruleNone
+	s.ports = append(s.ports[:i], append([]*portRules{p}, s.ports[i:]...)...)
+	return p.ruleSet
+}
 
-			np := new(ipNode)
-			np.bits = make([]byte, j)
-			copy(np.bits, p.bits[:j])
+// splitPortRule splits a rule address into the host and the port range,
+// e.g. "*.example.com:443", "[2001:db8::/32]:22" or "*:8000-8999". ok is
+// false if there's no port, lo is 0 if the ports are illegal.
+func splitPortRule(addr string) (host string, lo, hi int, ok bool) {
+	if _, isRegexp := cutPrefixFold(addr, regexpPrefix); isRegexp {
+		return
+	}
+	i := strings.LastIndexByte(addr, ':')
+	if i < 0 {
+		return
+	}
+	if addr[0] == '[' {
+		if addr[i-1] != ']' {
+			return
+		}
+		host = addr[1 : i-1]
+	} else if strings.IndexByte(addr[:i], ':') < 0 {
+		host = addr[:i]
+	} else {
+		return // an IPv6 address
+	}
 
-			pp.children[np.bits[0]] = np
+	ok = true
+	ports := strings.SplitN(addr[i+1:], "-", 2)
+	lo, err := strconv.Atoi(ports[0])
+	if err != nil {
+		return host, 0, 0, ok
+	}
+	hi = lo
+	if len(ports) == 2 {
+		if hi, err = strconv.Atoi(ports[1]); err != nil {
+			return host, 0, 0, ok
+		}
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return host, 0, 0, ok
+	}
+	return
+}
+
+// cutPrefixFold cuts the prefix from s ignoring case
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) <= len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return "", false
+	}
+	return s[len(prefix):], true
+}
 
-			copy(p.bits, p.bits[j:])
-			p.bits = p.bits[:len(p.bits)-j]
+// getRule returns the rule of addr at the port, port rules don't apply if
+// port is 0
+func (r *Rules) getRule(addr string, port int) int {
+	return r.lookupRule(addr, port, false)
+}
 
-			np.children[p.bits[0]] = p
-			pnode = np
-		} else if i == length-1 {
-			if j == len(p.bits)-1 {
-				node = p
-			} else {
-				np := new(ipNode)
-				np.bits = make([]byte, j+1)
-				copy(np.bits, p.bits[:j+1])
+// resolveRule is the same as getRule, except that domains without rules
+// are resolved to match IP and GEOIP rules if it's enabled
+func (r *Rules) resolveRule(addr string, port int) int {
+	return r.lookupRule(addr, port, true)
+}
 
-				pp.children[np.bits[0]] = np
-				node = np
+// lookupRule searches rules of addr with the port first, then rules of the
+// port alone, and then rules of addr
+func (r *Rules) lookupRule(addr string, port int, resolve bool) (rule int) {
+	if r == nil {
+		return ruleProxy
+	}
 
-				copy(p.bits, p.bits[j+1:])
-				p.bits = p.bits[:len(p.bits)-j-1]
+	s := r.rules()
+	if rule = r.portMatchRule(s, addr, port, resolve); rule == ruleNone {
+		rule = s.other
+	}
+	return r.cachedRule(addr, rule)
+}
 
-				np.children[p.bits[0]] = p
+// portMatchRule is the same as lookupRule except that it returns ruleNone
+// rather than the other rule if nothing matches
+func (r *Rules) portMatchRule(s *ruleSet, addr string, port int, resolve bool) (rule int) {
+	if port > 0 {
+		for _, p := range s.ports {
+			if p.lo <= port && port <= p.hi {
+				if rule = r.matchRule(p.ruleSet, addr, resolve); rule != ruleNone {
+					return
+				}
 			}
 		}
-
-		if pnode != nil {
-			node = new(ipNode)
-			node.bits = make([]byte, length-i)
-			for k := i; k < length; k++ {
-				node.bits[k-i] = (ip[k/8] >> (8 - k%8 - 1)) & 1
+		for _, p := range s.ports {
+			if p.lo <= port && port <= p.hi && p.other != ruleNone {
+				return p.other
 			}
-			pnode.children[node.bits[0]] = node
-		}
-
-		if node != nil {
-			node.rule = rule
-			break
 		}
-
-		j++
 	}
+	return r.matchRule(s, addr, resolve)
 }
 
-func setDomainRule(p *domainNode, domain string, rule int) error {
-	if i := strings.IndexByte(domain, '*'); i != 0 && i != -1 ||
-		strings.Count(domain, "*") > 1 {
-		return fmt.Errorf("Domain %q contains illegal wildcards", domain)
+// cachedRule turns the auto rule of addr into the proxy rule if addr is in
+// the proxy cache
+func (r *Rules) cachedRule(addr string, rule int) int {
+	if rule == ruleAuto && r.cache.contains(addr) {
+		return ruleProxy
 	}
+	return rule
+}
 
-	parts := strings.Split(domain, ".")
+// sniffedRule returns the rule of a connection to the IP whose domain is
+// sniffed, and the host the rule belongs to. The domain decides if it has
+// rules, otherwise the IP does, but it never lifts a reject of the IP. ip
+// may be a domain too if nothing is sniffed.
+func (r *Rules) sniffedRule(ip, domain string, port int) (string, int) {
+	if domain == ip {
+		return ip, r.resolveRule(ip, port)
+	}
+	if r == nil {
+		return domain, ruleProxy
+	}
 
-	for i := len(parts) - 1; i > 0; i-- {
-		part := parts[i]
-		if p.children[part] == nil {
-			p.children[part] = newDomainNode()
-		}
-		p = p.children[part]
+	s := r.rules()
+	rule := r.portMatchRule(s, ip, port, false)
+	if rule == ruleReject {
+		return ip, rule
+	}
+	if rule := r.portMatchRule(s, domain, port, false); rule != ruleNone {
+		return domain, r.cachedRule(domain, rule)
+	}
+	if rule == ruleNone {
+		rule = s.other
 	}
+	return ip, r.cachedRule(ip, rule)
+}
 
-	if part := parts[0]; part == "*" {
-		p.rule = rule
-		p.wild = true
-	} else {
-		if p.children[part] == nil {
-			p.children[part] = newDomainNode()
+// rejected returns whether addr is rejected at all ports
+func (r *Rules) rejected(addr string) bool {
+	if r.getRule(addr, 0) != ruleReject {
+		return false
+	}
+	for _, p := range r.rules().ports {
+		rule := r.matchRule(p.ruleSet, addr, false)
+		if rule == ruleNone {
+			rule = p.other
+		}
+		if rule != ruleNone && rule != ruleReject {
+			return false
 		}
-		p.children[part].rule = rule
 	}
-
-	return nil
+	return true
 }
 
-func searchIPRule(root *ipNode, ip []byte) (rule int) {
-	p := root
-	j := 0
-	for i := 0; i < len(ip)*8; i++ {
-		b := (ip[i/8] >> (8 - i%8 - 1)) & 1
-
-		if j >= len(p.bits) {
-			j = 0
-			p = p.children[b]
-		}
+// sniffAllowed returns whether a connection to the IP may be allowed once
+// its domain is sniffed, i.e. the IP isn't rejected, or it's rejected by
+// the other rule and some domain rules aren't rejects
+func (r *Rules) sniffAllowed(ip string, port int) bool {
+	if r == nil {
+		return true
+	}
 
-		if p == nil || p.bits[j] != b {
-			break
+	s := r.rules()
+	switch r.portMatchRule(s, ip, port, false) {
+	case ruleReject:
+		return false
+	case ruleNone:
+		if s.other != ruleReject {
+			return true
 		}
-
-		if j == len(p.bits)-1 && p.rule != ruleNone {
-			rule = p.rule
+	default:
+		return true
+	}
+	if s.domainsAllowed {
+		return true
+	}
+	for _, p := range s.ports {
+		if p.lo <= port && port <= p.hi && p.domainsAllowed {
+			return true
 		}
-
-		j++
 	}
-	return
+	return false
 }
 
-func (r *Rules) getRule(addr string) (rule int) {
-	if r == nil {
-		return ruleProxy
+// matchRule searches rules of addr in s, except the other rule. Domains
+// match domain rules, then keywords and regular expressions.
+func (r *Rules) matchRule(s *ruleSet, addr string, resolve bool) (rule int) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return r.ipRule(s, ip)
 	}
 
-	r.ruleMu.RLock()
-	if ip := net.ParseIP(addr); ip != nil {
-		if ipv4 := ip.To4(); ipv4 != nil { // IPv4
-			rule = searchIPRule(r.ipv4Tree, ipv4)
-		} else { // IPv6
-			rule = searchIPRule(r.ipv6Tree, ip.To16())
-		}
-	} else {
-		parts := strings.Split(addr, ".")
-		p := r.domainTree
-		for i := len(parts) - 1; i >= 0; i-- {
-			part := parts[i]
-			p = p.children[part]
-			if p == nil {
-				break
-			}
+	if rule = s.tree.Domains.Match(addr); rule != ruleNone {
+		return
+	}
 
-			if p.rule != ruleNone && (p.wild || i == 0) {
-				rule = p.rule
-			}
+	for _, k := range s.keywords {
+		if strings.Contains(addr, k.keyword) {
+			return k.rule
 		}
 	}
-	r.ruleMu.RUnlock()
-
-	if rule == ruleNone {
-		rule = r.other
+	for _, re := range s.regexps {
+		if re.re.MatchString(addr) {
+			return re.rule
+		}
 	}
 
-	if rule == ruleAuto {
-		r.mu.RLock()
-		if r.isProxy[addr] {
-			rule = ruleProxy
+	if resolve && r.geoIP != nil && r.geoIP.resolve {
+		if ip := r.geoIP.lookupIP(addr); ip != nil {
+			rule = r.ipRule(s, ip)
 		}
-		r.mu.RUnlock()
 	}
 	return
 }
 
-func (r *Rules) setAsProxy(addr string) {
+// ipRule searches the IP trees, and then GEOIP rules
+func (r *Rules) ipRule(s *ruleSet, ip net.IP) (rule int) {
+	rule = s.tree.MatchIP(ip)
+
+	if rule == ruleNone && r.geoIP != nil && len(s.geoRules) > 0 {
+		rule = s.geoRules[r.geoIP.country(ip)]
+	}
+	return
+}
+
+// proxyCache returns addresses that are cached to be proxied
+func (r *Rules) proxyCache() []string {
 	if r == nil {
-		return
+		return []string{}
 	}
+	return r.cache.list()
+}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// removeProxyCache removes addr from the cache and rewrites the cache file,
+// it returns false if addr is not cached
+func (r *Rules) removeProxyCache(addr string) (bool, error) {
+	if r == nil {
+		return false, nil
+	}
+	return r.cache.remove(addr)
+}
 
-	if !r.isProxy[addr] {
-		r.isProxy[addr] = true
-		r.cacheFile.WriteString(addr + "\n")
+// setAsProxy caches addr to be proxied, port is used to recheck it
+func (r *Rules) setAsProxy(addr string, port int) {
+	if r == nil {
+		return
 	}
+	r.cache.add(addr, port)
 }
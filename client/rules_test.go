@@ -2,10 +2,14 @@ package client
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/luyuhuang/subsocks/trie"
 )
 
 func TestRulesDomain(t *testing.T) {
@@ -47,7 +51,7 @@ func TestRulesDomain(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		if r := rule.getRule(c.addr); r != c.rule {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
 			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
 		}
 	}
@@ -83,7 +87,7 @@ func TestRulesIPv4(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		if r := rule.getRule(c.addr); r != c.rule {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
 			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
 		}
 	}
@@ -112,7 +116,7 @@ func TestRulesIPv6(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		if r := rule.getRule(c.addr); r != c.rule {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
 			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
 		}
 	}
@@ -136,7 +140,7 @@ func TestIPRulesOrder(t *testing.T) {
 		{"127.0.0.1", 32, ruleProxy},
 	}
 	for _, c := range rules {
-		setIPRule(rule.ipv4Tree, net.ParseIP(c.ip).To4(), c.l, c.rule)
+		rule.tree.IPv4.Set(net.ParseIP(c.ip).To4(), c.l, c.rule)
 	}
 
 	cases := []struct {
@@ -150,7 +154,7 @@ func TestIPRulesOrder(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		if r := rule.getRule(c.addr); r != c.rule {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
 			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
 		}
 	}
@@ -190,7 +194,7 @@ func TestRulesOther(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		if r := rule.getRule(c.addr); r != c.rule {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
 			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
 		}
 	}
@@ -205,7 +209,11 @@ func TestRulesIllegal(t *testing.T) {
 		{"www.*.com", "P", "contains illegal wildcards"},
 		{"www*.google.com", "P", "contains illegal wildcards"},
 		{"**", "P", "contains illegal wildcards"},
-		{"www.google.com", "proyx", "want proxy|direct|auto|P|D|A"},
+		{"www.google.com", "proyx", "want proxy|direct|auto|reject|P|D|A|R"},
+		{"*:0", "P", "are illegal"},
+		{"*.google.com:65536", "P", "are illegal"},
+		{"port 443-80", "P", "are illegal"},
+		{"REGEXP,(", "P", "is illegal"},
 	}
 
 	for _, c := range cases {
@@ -214,6 +222,122 @@ func TestRulesIllegal(t *testing.T) {
 			t.Fatalf("Error %q does not contain %q", err, c.err)
 		}
 	}
+
+	// a leading wildcard without a dot has been accepted as a label
+	if _, err := NewRulesFromMap(map[string]string{"*google.com": "P"}); err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+}
+
+func TestRulesKeywordRegexp(t *testing.T) {
+	rule, err := NewRulesFromMap(map[string]string{
+		"KEYWORD,google":           "P",
+		`regexp,ads?\.[a-z]+\.com`: "R",
+		"*.google.cn":              "D",
+		"*":                        "A",
+	})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	cases := []struct {
+		addr string
+		rule int
+	}{
+		{"www.google.com", ruleProxy},
+		{"googleapis.com", ruleProxy},
+		{"www.google.cn", ruleDirect}, // domain rules go first
+		{"ad.example.com", ruleReject},
+		{"ads.example.com", ruleReject},
+		{"x.ads.example.com", ruleAuto}, // regexps are anchored
+		{"ads.example.com.cn", ruleAuto},
+		{"1.2.3.4", ruleAuto},
+	}
+
+	for _, c := range cases {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
+			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
+		}
+	}
+}
+
+func TestRulesKeywordOrder(t *testing.T) {
+	rules := map[string]string{
+		"KEYWORD,goo":         "D",
+		"KEYWORD,google":      "R",
+		`REGEXP,.*\.com`:      "D",
+		`REGEXP,www\..*\.com`: "P",
+	}
+
+	// the longest one wins no matter the order of the map
+	for i := 0; i < 100; i++ {
+		rule, err := NewRulesFromMap(rules)
+		if err != nil {
+			t.Fatalf("Create rules failed: %s", err)
+		}
+		if r := rule.getRule("www.google.com", 0); r != ruleReject {
+			t.Fatalf("www.google.com rule got %d, want %d", r, ruleReject)
+		}
+		if r := rule.getRule("www.example.com", 0); r != ruleProxy {
+			t.Fatalf("www.example.com rule got %d, want %d", r, ruleProxy)
+		}
+	}
+}
+
+func TestRulesPort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	content := `port 22         D
+*.example.com:443   R
+10.0.0.0/8:8000-8999  D
+[2001:db8::/32]:22  R
+*:80                auto
+*.example.com       D
+*.internal          R
+*                   P
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Write rules failed: %s", err)
+	}
+	rule, err := NewRulesFromFile(path)
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	cases := []struct {
+		addr string
+		port int
+		rule int
+	}{
+		{"github.com", 22, ruleDirect},
+		{"github.com", 443, ruleProxy},
+		{"www.example.com", 443, ruleReject},
+		{"www.example.com", 80, ruleAuto}, // port rules go first
+		{"www.example.com", 0, ruleDirect},
+		{"10.1.1.1", 8080, ruleDirect},
+		{"10.1.1.1", 9000, ruleProxy},
+		{"2001:db8::1", 22, ruleReject}, // rules with addresses go first
+		{"2001:db8::1", 23, ruleProxy},
+	}
+
+	for _, c := range cases {
+		if r := rule.getRule(c.addr, c.port); r != c.rule {
+			t.Fatalf("%q:%d rule got %d, want %d", c.addr, c.port, r, c.rule)
+		}
+	}
+
+	rule, err = NewRulesFromMap(map[string]string{
+		"*.example.com:443": "P",
+		"*":                 "R",
+	})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	if rule.rejected("www.example.com") {
+		t.Fatalf("www.example.com should be allowed at port 443")
+	}
+	if !rule.rejected("www.example.org") {
+		t.Fatalf("www.example.org should be rejected at all ports")
+	}
 }
 
 func TestRulesFile(t *testing.T) {
@@ -258,7 +382,7 @@ func TestRulesFile(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		if r := rule.getRule(c.addr); r != c.rule {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
 			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
 		}
 	}
@@ -292,26 +416,115 @@ func TestRulesFileIllegal(t *testing.T) {
 	f.Close()
 
 	_, err = NewRulesFromFile(path)
-	if err == nil || !strings.Contains(err.Error(), "want proxy|direct|auto|P|D|A") {
-		t.Fatalf("Error %q does not contain 'want proxy|direct|auto|P|D|A'", err)
+	if err == nil || !strings.Contains(err.Error(), "want proxy|direct|auto|reject|P|D|A|R") {
+		t.Fatalf("Error %q does not contain 'want proxy|direct|auto|reject|P|D|A|R'", err)
+	}
+}
+
+func TestRulesReject(t *testing.T) {
+	rule, err := NewRulesFromMap(map[string]string{
+		"*.doubleclick.net":     "R",
+		"telemetry.example.com": "reject",
+		"10.1.1.0/24":           "R",
+		"www.doubleclick.net":   "D",
+		"*":                     "P",
+	})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	cases := []struct {
+		addr string
+		rule int
+	}{
+		{"doubleclick.net", ruleReject},
+		{"ad.doubleclick.net", ruleReject},
+		{"www.doubleclick.net", ruleDirect},
+		{"telemetry.example.com", ruleReject},
+		{"www.example.com", ruleProxy},
+		{"10.1.1.1", ruleReject},
+		{"10.1.2.1", ruleProxy},
+	}
+
+	for _, c := range cases {
+		if r := rule.getRule(c.addr, 0); r != c.rule {
+			t.Fatalf("%q rule got %d, want %d", c.addr, r, c.rule)
+		}
 	}
 }
 
-func printIPTree(n *ipNode, k int) {
+func TestRulesGroup(t *testing.T) {
+	rule, err := NewRulesFromMap(map[string]string{
+		"*.corp.example": "office",
+		"10.0.0.0/8":     "office",
+		"github.com":     "P",
+		"*":              "us-east",
+	}, "office", "us-east")
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	path := fmt.Sprintf("%s%crule.txt", t.TempDir(), os.PathSeparator)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0664)
+	if err != nil {
+		t.Fatalf("Create file %q failed %q", path, err)
+	}
+	f.WriteString("*.corp.example  office\n")
+	f.WriteString("10.0.0.0/8\n")
+	f.WriteString("github.com      P\n")
+	f.WriteString("*               us-east\n")
+	f.Close()
+
+	fileRule, err := NewRulesFromFile(path, "office", "us-east")
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	defer fileRule.watcher.Close()
+
+	cases := []struct {
+		addr  string
+		group string
+		rule  int
+	}{
+		{"git.corp.example", "office", ruleGroup},
+		{"10.1.1.1", "office", ruleGroup},
+		{"github.com", "", ruleProxy},
+		{"www.google.com", "us-east", ruleGroup + 1},
+	}
+
+	for _, r := range []*Rules{rule, fileRule} {
+		for _, c := range cases {
+			got := r.getRule(c.addr, 0)
+			if got != c.rule || !isProxyRule(got) {
+				t.Fatalf("%q rule got %d, want %d", c.addr, got, c.rule)
+			}
+			if g := r.groupOf(got); g != c.group {
+				t.Fatalf("%q group got %q, want %q", c.addr, g, c.group)
+			}
+		}
+	}
+
+	_, err = NewRulesFromMap(map[string]string{"*": "office"})
+	if err == nil || !strings.Contains(err.Error(), "want proxy|direct|auto|reject|P|D|A|R") {
+		t.Fatalf("Error %q does not contain 'want proxy|direct|auto|reject|P|D|A|R'", err)
+	}
+}
+
+func printIPTree(n *trie.IPNode, k int) {
 	fmt.Printf(strings.Repeat("  ", k))
-	if n == nil || len(n.bits) <= 0 {
+	if n == nil || len(n.Bits) <= 0 {
 		fmt.Printf("-")
 	} else {
-		for _, b := range n.bits {
+		for _, b := range n.Bits {
 			fmt.Printf("%d", b)
 		}
-		fmt.Printf(" (%d)", len(n.bits))
+		fmt.Printf(" (%d)", len(n.Bits))
 	}
 	fmt.Println()
 
 	if n != nil {
-		printIPTree(n.children[0], k+1)
-		printIPTree(n.children[1], k+1)
+		printIPTree(n.Children[0], k+1)
+		printIPTree(n.Children[1], k+1)
 	}
 }
 
@@ -327,7 +540,7 @@ func printIPTree(n *ipNode, k int) {
 // 		{"127.0.0.1", 32},
 // 	}
 
-// 	root := &ipNode{}
+// 	root := &trie.IPNode{}
 
 // 	for _, c := range cases {
 // 		fmt.Printf("%s\t", c.ip)
@@ -338,8 +551,51 @@ func printIPTree(n *ipNode, k int) {
 // 		}
 // 		fmt.Printf(" (%d)\n", c.l)
 
-// 		setIPRule(root, ip, c.l, ruleDirect)
+// 		root.Set(ip, c.l, ruleDirect)
 // 	}
 // 	printIPTree(root, 0)
 
 // }
+
+func TestRulesProxyCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache", "proxy-cache")
+	r, err := NewRulesFromMap(map[string]string{"*": "A"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	if err := r.LoadCache(path, 0); err != nil {
+		t.Fatalf("Load cache failed: %s", err)
+	}
+	r.setAsProxy("a.example.com", 443)
+	r.setAsProxy("b.example.com", 443)
+
+	cache := strings.Join(r.proxyCache(), ",")
+	if cache != "a.example.com,b.example.com" {
+		t.Fatalf("Cache got %s, want a.example.com,b.example.com", cache)
+	}
+
+	if ok, err := r.removeProxyCache("a.example.com"); !ok || err != nil {
+		t.Fatalf("Remove a.example.com got %v, %v, want true, nil", ok, err)
+	}
+	if ok, _ := r.removeProxyCache("a.example.com"); ok {
+		t.Fatalf("Remove a.example.com again should fail")
+	}
+	if rule := r.getRule("a.example.com", 0); rule != ruleAuto {
+		t.Fatalf("Rule of a.example.com got %d, want %d", rule, ruleAuto)
+	}
+
+	// the cache file is rewritten
+	r2, err := NewRulesFromMap(map[string]string{"*": "A"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	if err := r2.LoadCache(path, 0); err != nil {
+		t.Fatalf("Load cache failed: %s", err)
+	}
+	if rule := r2.getRule("a.example.com", 0); rule != ruleAuto {
+		t.Fatalf("Rule of a.example.com got %d, want %d", rule, ruleAuto)
+	}
+	if rule := r2.getRule("b.example.com", 0); rule != ruleProxy {
+		t.Fatalf("Rule of b.example.com got %d, want %d", rule, ruleProxy)
+	}
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+const (
+	// sniffTimeout is the time to wait for the first bytes, protocols that
+	// the server speaks first would wait this long
+	sniffTimeout = 300 * time.Millisecond
+	// sniffLimit is the most bytes to read, a TLS record is at most 16K
+	sniffLimit = 5 + 16*1024
+)
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+// sniffedConn replays the sniffed bytes before reading the connection
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// sniff reads the first bytes of conn for the domain of addr if it's an
+// IP. It returns the connection to read from instead, the host to match
+// rules, and the address to connect, which is the domain if the override
+// is on.
+func (c *Client) sniff(conn net.Conn, addr *socks.Addr) (net.Conn, string, *socks.Addr) {
+	if !c.Config.Sniff || addr.Type == socks.AddrDomain {
+		return conn, addr.Host, addr
+	}
+
+	b := make([]byte, 0, 1024)
+	domain := ""
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	for {
+		if len(b) == cap(b) {
+			b = append(b, 0)[:len(b)]
+		}
+		n, err := conn.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+
+		var done bool
+		if domain, done = sniffDomain(b); done || err != nil || len(b) >= sniffLimit {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	conn = &sniffedConn{conn, io.MultiReader(bytes.NewReader(b), conn)}
+	if domain == "" {
+		return conn, addr.Host, addr
+	}
+	log.Printf(`[sniff] sniffed %s for %s`, domain, addr)
+	if c.Config.SniffOverride {
+		return conn, domain, socks.NewAddrFromPair(domain, int(addr.Port))
+	}
+	return conn, domain, addr
+}
+
+// sniffDomain looks for the domain in the TLS ClientHello or the HTTP
+// request. done is false if more bytes are needed.
+func sniffDomain(b []byte) (domain string, done bool) {
+	if len(b) == 0 {
+		return "", false
+	}
+
+	if b[0] == 0x16 { // TLS handshake
+		if len(b) < 5 {
+			return "", false
+		}
+		end := 5 + int(binary.BigEndian.Uint16(b[3:]))
+		if len(b) < end && len(b) < sniffLimit {
+			return "", false
+		}
+		if end > len(b) {
+			end = len(b)
+		}
+		return validDomain(parseSNI(b[5:end])), true
+	}
+
+	for _, m := range httpMethods {
+		if len(b) < len(m) {
+			if strings.HasPrefix(m, string(b)) {
+				return "", false
+			}
+			continue
+		}
+		if string(b[:len(m)]) != m {
+			continue
+		}
+		if !bytes.Contains(b, []byte("\r\n\r\n")) {
+			return "", false
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return "", true
+		}
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return validDomain(host), true
+	}
+	return "", true
+}
+
+// parseSNI returns the server name of the ClientHello message
+func parseSNI(b []byte) string {
+	// handshake type, length, version and random
+	if len(b) < 38 || b[0] != 1 {
+		return ""
+	}
+	b = b[38:]
+
+	// session ID, cipher suites and compression methods
+	for _, size := range []int{1, 2, 1} {
+		if len(b) < size {
+			return ""
+		}
+		l := size
+		if size == 1 {
+			l += int(b[0])
+		} else {
+			l += int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < l {
+			return ""
+		}
+		b = b[l:]
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return ""
+		}
+		ext := b[4 : 4+l]
+		b = b[4+l:]
+		if typ != 0 { // server_name
+			continue
+		}
+
+		// server name list, name type and name
+		if len(ext) < 5 || ext[2] != 0 {
+			return ""
+		}
+		l = int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+l {
+			return ""
+		}
+		return string(ext[5 : 5+l])
+	}
+	return ""
+}
+
+// validDomain returns the lowercase domain, or empty if it's not a domain
+func validDomain(s string) string {
+	s = strings.TrimSuffix(strings.ToLower(s), ".")
+	if s == "" || len(s) > 253 || net.ParseIP(s) != nil {
+		return ""
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_') {
+			return ""
+		}
+	}
+	return s
+}
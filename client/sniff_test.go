@@ -0,0 +1,170 @@
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+// clientHello returns the first record sent by a TLS client
+func clientHello(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: serverName}).Handshake()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c2, header); err != nil {
+		t.Fatalf("Read ClientHello failed: %s", err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(c2, body); err != nil {
+		t.Fatalf("Read ClientHello failed: %s", err)
+	}
+	c1.Close()
+	return append(header, body...)
+}
+
+func TestSniffDomain(t *testing.T) {
+	hello := clientHello(t, "WWW.Example.com")
+	httpReq := []byte("GET / HTTP/1.1\r\nHost: www.example.org:8080\r\nAccept: */*\r\n\r\n")
+
+	cases := []struct {
+		b      []byte
+		domain string
+		done   bool
+	}{
+		{hello, "www.example.com", true},
+		{hello[:3], "", false},
+		{hello[:len(hello)-1], "", false},
+		{clientHello(t, "1.2.3.4"), "", true},
+		{httpReq, "www.example.org", true},
+		{[]byte("GET / HTTP/1.1\r\nHost: 1.2.3.4\r\n\r\n"), "", true},
+		{httpReq[:2], "", false},
+		{httpReq[:20], "", false},
+		{[]byte("SSH-2.0-OpenSSH_8.4\r\n"), "", true},
+		{[]byte{}, "", false},
+	}
+	for _, c := range cases {
+		domain, done := sniffDomain(c.b)
+		if domain != c.domain || done != c.done {
+			t.Fatalf("Sniff %q got %q, %v, want %q, %v", c.b, domain, done, c.domain, c.done)
+		}
+	}
+}
+
+func TestSniff(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	addr := socks.NewAddrFromPair("1.2.3.4", 443)
+
+	for _, override := range []bool{false, true} {
+		c := NewClient("127.0.0.1:1030")
+		c.Config.Sniff = true
+		c.Config.SniffOverride = override
+
+		c1, c2 := net.Pipe()
+		go func() {
+			c2.Write(hello)
+			c2.Close()
+		}()
+
+		conn, host, dst := c.sniff(c1, addr)
+		if host != "www.example.com" {
+			t.Fatalf("Sniffed host got %q, want www.example.com", host)
+		}
+		if want := map[bool]string{false: "1.2.3.4:443", true: "www.example.com:443"}[override]; dst.String() != want {
+			t.Fatalf("Sniffed address with override %v got %s, want %s", override, dst, want)
+		}
+		if b, _ := ioutil.ReadAll(conn); string(b) != string(hello) {
+			t.Fatalf("Sniffed bytes aren't replayed")
+		}
+	}
+
+	// the server speaks first, gives up after the timeout
+	c := NewClient("127.0.0.1:1030")
+	c.Config.Sniff = true
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn, host, dst := c.sniff(c1, addr)
+	if host != "1.2.3.4" || dst != addr {
+		t.Fatalf("Sniff without data got %q, %s", host, dst)
+	}
+	go c2.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Fatalf("Read after sniffing got %q, %v", b, err)
+	}
+}
+
+func TestSniffReject(t *testing.T) {
+	cases := []struct {
+		rules map[string]string
+		rep   uint8
+	}{
+		// no domain can change the rule of the IP
+		{map[string]string{"1.2.3.4": "R", "*": "D"}, socks.Allowed},
+		{map[string]string{"*": "R", "*.example.com": "R"}, socks.Allowed},
+		// the sniffed domain never lifts a reject of the IP
+		{map[string]string{"1.2.3.4": "R", "www.example.com": "D"}, socks.Allowed},
+		{map[string]string{"1.2.3.4": "R", "*.corp.example": "D", "*": "P"}, socks.Allowed},
+		// the sniffed domain may be allowed
+		{map[string]string{"*": "R", "KEYWORD,example": "D"}, socks.Succeeded},
+	}
+
+	for _, c := range cases {
+		cli := NewClient("127.0.0.1:1080")
+		cli.Config.Sniff = true
+		var err error
+		cli.Rules, err = NewRulesFromMap(c.rules)
+		if err != nil {
+			t.Fatalf("Create rules failed: %s", err)
+		}
+
+		c1, c2 := net.Pipe()
+		go cli.handleConnect(c2, socks.NewRequest(socks.CmdConnect, socks.NewAddrFromPair("1.2.3.4", 443)))
+		rep, err := socks.ReadReply(c1)
+		if err != nil {
+			t.Fatalf("Read reply failed: %s", err)
+		}
+		if rep.Rep != c.rep {
+			t.Fatalf("Reply with rules %v got %d, want %d", c.rules, rep.Rep, c.rep)
+		}
+		c1.Close()
+	}
+}
+
+func TestSniffedRule(t *testing.T) {
+	cases := []struct {
+		rules  map[string]string
+		ip     string
+		domain string
+		host   string
+		rule   int
+	}{
+		{map[string]string{"1.2.3.4": "R", "*.corp.example": "D", "*": "P"}, "1.2.3.4", "evil.com", "1.2.3.4", ruleReject},
+		{map[string]string{"1.2.3.4": "R", "evil.com": "D"}, "1.2.3.4", "evil.com", "1.2.3.4", ruleReject},
+		{map[string]string{"*:443": "R", "evil.com": "D"}, "1.2.3.4", "evil.com", "1.2.3.4", ruleReject},
+		// the IP decides if the domain has no rules
+		{map[string]string{"10.0.0.0/8": "D", "*": "P"}, "10.1.2.3", "foo.com", "10.1.2.3", ruleDirect},
+		{map[string]string{"*": "P"}, "10.1.2.3", "foo.com", "10.1.2.3", ruleProxy},
+		// the domain decides if it has rules
+		{map[string]string{"10.0.0.0/8": "D", "foo.com": "P"}, "10.1.2.3", "foo.com", "foo.com", ruleProxy},
+		{map[string]string{"*": "R", "KEYWORD,example": "D"}, "1.2.3.4", "www.example.com", "www.example.com", ruleDirect},
+		// nothing is sniffed
+		{map[string]string{"*": "R", "KEYWORD,example": "D"}, "1.2.3.4", "1.2.3.4", "1.2.3.4", ruleReject},
+	}
+
+	for _, c := range cases {
+		r, err := NewRulesFromMap(c.rules)
+		if err != nil {
+			t.Fatalf("Create rules failed: %s", err)
+		}
+		host, rule := r.sniffedRule(c.ip, c.domain, 443)
+		if host != c.host || rule != c.rule {
+			t.Fatalf("Sniffed rule of %s %s with rules %v got %s %d, want %s %d", c.ip, c.domain, c.rules, host, rule, c.host, c.rule)
+		}
+	}
+}
@@ -2,19 +2,25 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 
 	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
 	"github.com/luyuhuang/subsocks/utils"
 )
 
-func (c *Client) wrapSocks(conn net.Conn) net.Conn {
+func (u *Upstream) wrapSocks(conn net.Conn) net.Conn {
 	return conn
 }
 
+func (u *Upstream) wrapTLS(conn net.Conn) net.Conn {
+	return tls.Client(conn, u.TLSConfig)
+}
+
 func (c *Client) socks5Handler(conn net.Conn) {
 	defer conn.Close()
 
@@ -35,10 +41,13 @@ func (c *Client) socks5Handler(conn net.Conn) {
 		return
 	}
 
-	if err := method2Handler[method](c, conn); err != nil {
+	user, err := method2Handler[method](c, conn)
+	if err != nil {
+		authFailures.Inc("socks")
 		log.Printf(`[socks5] authorization failed: %s`, err)
 		return
 	}
+	conn = utils.WithUser(conn, user)
 
 	// read command
 	request, err := socks.ReadRequest(conn)
@@ -77,16 +86,16 @@ func (c *Client) chooseMethod(methods []uint8) uint8 {
 	return socks.MethodNoAcceptable
 }
 
-var method2Handler = map[uint8]func(*Client, net.Conn) error{
+var method2Handler = map[uint8]func(*Client, net.Conn) (string, error){
 	socks.MethodNoAuth:   (*Client).authNoAuth,
 	socks.MethodUserPass: (*Client).authUserPass,
 }
 
-func (c *Client) authNoAuth(conn net.Conn) (err error) {
-	return nil
+func (c *Client) authNoAuth(conn net.Conn) (user string, err error) {
+	return "", nil
 }
 
-func (c *Client) authUserPass(conn net.Conn) (err error) {
+func (c *Client) authUserPass(conn net.Conn) (user string, err error) {
 	req, err := socks.ReadUserPassRequest(conn)
 	if err != nil {
 		return
@@ -96,80 +105,96 @@ func (c *Client) authUserPass(conn net.Conn) (err error) {
 		if e := socks.NewUserPassResponse(socks.UserPassVer, 1).Write(conn); e != nil {
 			log.Printf(`[socks5] write reply failed: %s`, e)
 		}
-		return fmt.Errorf(`verify user %s failed`, req.Username)
+		return "", fmt.Errorf(`verify user %s failed`, req.Username)
 	}
 
-	return socks.NewUserPassResponse(socks.UserPassVer, 0).Write(conn)
+	return req.Username, socks.NewUserPassResponse(socks.UserPassVer, 0).Write(conn)
 }
 
 func (c *Client) handleConnect(conn net.Conn, req *socks.Request) {
-	var nextHop net.Conn
-	var err error
-	var isProxy bool
+	c.connect("socks5", conn, req.Addr, func(rep uint8) error {
+		return socks.NewReply(rep, nil).Write(conn)
+	})
+}
 
-	if rule := c.Rules.getRule(req.Addr.Host); rule == ruleProxy {
-		log.Printf(`[socks5] "connect" dial server to connect %s for %s`, req.Addr, conn.RemoteAddr())
+// connect connects to addr according to the rules and tunnels conn to it,
+// reply writes the socks5 reply code in the protocol of tag
+func (c *Client) connect(tag string, conn net.Conn, addr *socks.Addr, reply func(rep uint8) error) {
+	realAddr, err := c.realAddr(addr)
+	if err != nil {
+		log.Printf(`[%s] "connect" %s %s from %s`, tag, err, addr, conn.RemoteAddr())
+		if err = reply(socks.HostUnreachable); err != nil {
+			log.Printf(`[%s] "connect" write reply failed: %s`, tag, err)
+		}
+		return
+	}
+	addr = realAddr
 
-		isProxy = true
-		nextHop, err = c.dialServer()
+	var nextHop net.Conn
+	var decision string
+	user := utils.UserOf(conn)
+	// a rejected IP is replied as usual unless a sniffed domain may be
+	// allowed
+	if c.Config.Sniff && addr.Type != socks.AddrDomain && c.Rules.sniffAllowed(addr.Host, int(addr.Port)) {
+		// the client sends nothing until the connect succeeds, so reply
+		// before sniffing and dialing
+		if err = reply(socks.Succeeded); err != nil {
+			log.Printf(`[%s] "connect" write reply failed: %s`, tag, err)
+			return
+		}
+
+		ip := addr.Host
+		var host string
+		conn, host, addr = c.sniff(conn, addr)
+		host, rule := c.Rules.sniffedRule(ip, host, int(addr.Port))
+		nextHop, decision, err = c.dialRule(tag, addr, host, rule, conn.RemoteAddr())
 		if err != nil {
-			log.Printf(`[socks5] "connect" dial server failed: %s`, err)
-			if err = socks.NewReply(socks.HostUnreachable, nil).Write(conn); err != nil {
-				log.Printf(`[socks5] "connect" write reply failed: %s`, err)
+			if err != errRejected {
+				log.Printf(`[%s] "connect" %s`, tag, err)
 			}
 			return
 		}
-		defer nextHop.Close()
 
 	} else {
-		log.Printf(`[socks5] "connect" dial %s for %s`, req.Addr, conn.RemoteAddr())
-
-		nextHop, err = net.Dial("tcp", req.Addr.String())
+		nextHop, decision, err = c.dialTarget(tag, addr, addr.Host, conn.RemoteAddr())
 		if err != nil {
-			if rule == ruleAuto {
-				log.Printf(`[socks5] "connect" dial %s failed, dial server for %s`, req.Addr, conn.RemoteAddr())
-
-				isProxy = true
-				nextHop, err = c.dialServer()
-				if err != nil {
-					log.Printf(`[socks5] "connect" dial server failed: %s`, err)
-					if err = socks.NewReply(socks.HostUnreachable, nil).Write(conn); err != nil {
-						log.Printf(`[socks5] "connect" write reply failed: %s`, err)
-					}
-					return
-				}
-				c.Rules.setAsProxy(req.Addr.Host)
+			rep := socks.HostUnreachable
+			if err == errRejected {
+				rep = socks.Allowed
 			} else {
-				log.Printf(`[socks5] "connect" dial remote failed: %s`, err)
-				if err = socks.NewReply(socks.HostUnreachable, nil).Write(conn); err != nil {
-					log.Printf(`[socks5] "connect" write reply failed: %s`, err)
+				log.Printf(`[%s] "connect" %s`, tag, err)
+				if e, ok := err.(*replyError); ok {
+					rep = e.rep
 				}
-				return
 			}
-		}
-		defer nextHop.Close()
-	}
-
-	var dash rune
-	if isProxy {
-		if err = req.Write(nextHop); err != nil {
-			log.Printf(`[socks5] "connect" send request failed: %s`, err)
+			if err = reply(rep); err != nil {
+				log.Printf(`[%s] "connect" write reply failed: %s`, tag, err)
+			}
 			return
 		}
-		dash = '-'
-	} else {
-		if err = socks.NewReply(socks.Succeeded, nil).Write(conn); err != nil {
-			log.Printf(`[socks5] "connect" write reply failed: %s`, err)
+
+		if err = reply(socks.Succeeded); err != nil {
+			nextHop.Close()
+			log.Printf(`[%s] "connect" write reply failed: %s`, tag, err)
 			return
 		}
-		dash = '='
 	}
+	defer nextHop.Close()
+
+	dash := dashOf(decision)
 
-	log.Printf(`[socks5] "connect" tunnel established %s <%c> %s`, conn.RemoteAddr(), dash, req.Addr)
-	if err := utils.Transport(conn, nextHop); err != nil {
-		log.Printf(`[socks5] "connect" transport failed: %s`, err)
+	log.Printf(`[%s] "connect" tunnel established %s <%c> %s`, tag, conn.RemoteAddr(), dash, addr)
+	t := &tunnel.Tunnel{
+		Command:     "connect",
+		User:        user,
+		Source:      conn.RemoteAddr().String(),
+		Destination: addr.String(),
+		Rule:        decision,
 	}
-	log.Printf(`[socks5] "connect" tunnel disconnected %s >%c< %s`, conn.RemoteAddr(), dash, req.Addr)
+	if err := c.transport(t, conn, nextHop); err != nil {
+		log.Printf(`[%s] "connect" transport failed: %s`, tag, err)
+	}
+	log.Printf(`[%s] "connect" tunnel disconnected %s >%c< %s`, tag, conn.RemoteAddr(), dash, addr)
 }
 
 func (c *Client) handleBind(conn net.Conn, req *socks.Request) {
@@ -189,7 +214,14 @@ func (c *Client) handleBind(conn net.Conn, req *socks.Request) {
 		return
 	}
 	log.Printf(`[socks5] "bind" tunnel established %s <-> ?%s`, conn.RemoteAddr(), req.Addr)
-	if err := utils.Transport(conn, ser); err != nil {
+	t := &tunnel.Tunnel{
+		Command:     "bind",
+		User:        utils.UserOf(conn),
+		Source:      conn.RemoteAddr().String(),
+		Destination: req.Addr.String(),
+		Rule:        decisionProxy,
+	}
+	if err := c.transport(t, conn, ser); err != nil {
 		log.Printf(`[socks5] Transport failed: %s`, err)
 	}
 	log.Printf(`[socks5] "bind" tunnel disconnected %s >-< ?%s`, conn.RemoteAddr(), req.Addr)
@@ -207,7 +239,7 @@ func (c *Client) handleUDP(conn net.Conn, req *socks.Request) {
 	}
 	defer udp.Close()
 
-	ser, err := c.requestServer4UDP()
+	ser, err := c.requestServer4UDP("")
 	if err != nil {
 		log.Printf(`[socks5] "udp" UDP associate failed on request the server: %s`, err)
 		if err := socks.NewReply(socks.Failure, nil).Write(conn); err != nil {
@@ -223,16 +255,26 @@ func (c *Client) handleUDP(conn net.Conn, req *socks.Request) {
 		return
 	}
 
-	log.Printf(`[socks5] "udp" tunnel established (UDP)%s <-> %s`, udp.LocalAddr(), c.Config.ServerAddr)
-	go tunnelUDP(udp, ser)
+	log.Printf(`[socks5] "udp" tunnel established (UDP)%s <-> %s`, udp.LocalAddr(), ser.RemoteAddr())
+	t := &tunnel.Tunnel{
+		Command:     "udp",
+		User:        utils.UserOf(conn),
+		Source:      "(UDP)" + udp.LocalAddr().String(),
+		Destination: ser.RemoteAddr().String(),
+		Rule:        decisionProxy,
+	}
+	c.openTunnel(t, conn, udp, ser)
+	defer c.closeTunnel(t)
+	go c.tunnelUDP(udp, ser, t)
 	if err := waiting4EOF(conn); err != nil {
 		log.Printf(`[socks5] "udp" waiting for EOF failed: %s`, err)
 	}
-	log.Printf(`[socks5] "udp" tunnel disconnected (UDP)%s >-< %s`, udp.LocalAddr(), c.Config.ServerAddr)
+	log.Printf(`[socks5] "udp" tunnel disconnected (UDP)%s >-< %s`, udp.LocalAddr(), ser.RemoteAddr())
 }
 
-func (c *Client) requestServer4UDP() (net.Conn, error) {
-	ser, err := c.dialServer()
+// requestServer4UDP requests a UDP over TCP channel from a server of the group
+func (c *Client) requestServer4UDP(group string) (net.Conn, error) {
+	ser, err := c.dialGroup(group)
 	if err != nil {
 		return nil, err
 	}
@@ -250,10 +292,14 @@ func (c *Client) requestServer4UDP() (net.Conn, error) {
 		ser.Close()
 		return nil, fmt.Errorf("Request UDP over TCP associate failed: %q", res.Rep)
 	}
+	// QUIC streams send datagrams apart
+	if d := utils.DatagramsOf(ser); d != nil {
+		return d, nil
+	}
 	return ser, nil
 }
 
-func tunnelUDP(udp net.PacketConn, conn net.Conn) error {
+func (c *Client) tunnelUDP(udp net.PacketConn, conn net.Conn, t *tunnel.Tunnel) error {
 	errc := make(chan error, 2)
 	var clientAddr net.Addr
 
@@ -276,11 +322,15 @@ func tunnelUDP(udp net.PacketConn, conn net.Conn) error {
 			if clientAddr == nil {
 				clientAddr = addr
 			}
+			if dgram.Header.Addr, err = c.realAddr(dgram.Header.Addr); err != nil {
+				continue
+			}
 			dgram.Header.Rsv = uint16(len(dgram.Data))
 			if err := dgram.Write(conn); err != nil {
 				errc <- err
 				return
 			}
+			countUp(t, len(dgram.Data))
 		}
 	}()
 
@@ -302,6 +352,7 @@ func tunnelUDP(udp net.PacketConn, conn net.Conn) error {
 				errc <- err
 				return
 			}
+			countDown(t, len(dgram.Data))
 		}
 	}()
 
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+// socks4Handler serves SOCKS4 and SOCKS4a. If the client requires
+// authorization, the user ID is "<username>:<password>".
+func (c *Client) socks4Handler(conn net.Conn) {
+	defer conn.Close()
+
+	req, err := socks.ReadRequest4(conn)
+	if err != nil {
+		log.Printf(`[socks4] read request failed: %s`, err)
+		return
+	}
+
+	// the password is never recorded, even if no authorization is required
+	user, password := req.UserID, ""
+	if i := strings.IndexByte(user, ':'); i >= 0 {
+		user, password = user[:i], user[i+1:]
+	}
+	if c.Config.Verify != nil {
+		if !c.Config.Verify(user, password) {
+			authFailures.Inc("socks")
+			log.Printf(`[socks4] authorization failed: verify user %s failed`, user)
+			if err := socks.NewReply4(socks.Rejected4, nil).Write(conn); err != nil {
+				log.Printf(`[socks4] write reply failed: %s`, err)
+			}
+			return
+		}
+	}
+	conn = utils.WithUser(conn, user)
+
+	switch req.Cmd {
+	case socks.CmdConnect:
+		c.connect("socks4", conn, req.Addr, func(rep uint8) error {
+			return socks.NewReply4(reply4Of(rep), nil).Write(conn)
+		})
+	case socks.CmdBind:
+		c.handleBind4(conn, req)
+	default:
+		log.Printf(`[socks4] unsupported command %d`, req.Cmd)
+		if err := socks.NewReply4(socks.Rejected4, nil).Write(conn); err != nil {
+			log.Printf(`[socks4] write reply failed: %s`, err)
+		}
+	}
+}
+
+// reply4Of maps a socks5 reply code to the SOCKS4 one
+func reply4Of(rep uint8) uint8 {
+	if rep == socks.Succeeded {
+		return socks.Granted4
+	}
+	return socks.Rejected4
+}
+
+// handleBind4 binds via the server like socks5 does, replies of the server
+// are translated into SOCKS4 ones
+func (c *Client) handleBind4(conn net.Conn, req *socks.Request4) {
+	log.Printf(`[socks4] "bind" dial server to bind %s for %s`, req.Addr, conn.RemoteAddr())
+
+	ser, err := c.dialServer()
+	if err != nil {
+		log.Printf(`[socks4] "bind" dial server failed: %s`, err)
+		if err := socks.NewReply4(socks.Rejected4, nil).Write(conn); err != nil {
+			log.Printf(`[socks4] "bind" write reply failed: %s`, err)
+		}
+		return
+	}
+	defer ser.Close()
+	if err := socks.NewRequest(socks.CmdBind, req.Addr).Write(ser); err != nil {
+		log.Printf(`[socks4] "bind" send request failed: %s`, err)
+		return
+	}
+
+	// the first reply is the address the server listens on, and the
+	// second one is the peer connected to it
+	for i := 0; i < 2; i++ {
+		r, err := socks.ReadReply(ser)
+		if err != nil {
+			log.Printf(`[socks4] "bind" read reply failed: %s`, err)
+			return
+		}
+		if err := socks.NewReply4(reply4Of(r.Rep), r.Addr).Write(conn); err != nil {
+			log.Printf(`[socks4] "bind" write reply failed: %s`, err)
+			return
+		}
+		if r.Rep != socks.Succeeded {
+			return
+		}
+	}
+
+	log.Printf(`[socks4] "bind" tunnel established %s <-> ?%s`, conn.RemoteAddr(), req.Addr)
+	t := &tunnel.Tunnel{
+		Command:     "bind",
+		User:        utils.UserOf(conn),
+		Source:      conn.RemoteAddr().String(),
+		Destination: req.Addr.String(),
+		Rule:        decisionProxy,
+	}
+	if err := c.transport(t, conn, ser); err != nil {
+		log.Printf(`[socks4] "bind" transport failed: %s`, err)
+	}
+	log.Printf(`[socks4] "bind" tunnel disconnected %s >-< ?%s`, conn.RemoteAddr(), req.Addr)
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func TestSocks4Connect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	cli := NewClient("127.0.0.1:1080")
+	cli.Rules, err = NewRulesFromMap(map[string]string{"*": "D"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+	cli.Config.Verify = func(user, password string) bool {
+		return user == "u" && password == "p"
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go cli.socks4Handler(conn)
+		}
+	}()
+
+	cases := []struct {
+		addr   *socks.Addr
+		userID string
+		rep    uint8
+	}{
+		{socks.NewAddrFromPair("127.0.0.1", port), "u:p", socks.Granted4},
+		{socks.NewAddrFromPair("localhost", port), "u:p", socks.Granted4}, // SOCKS4a
+		{socks.NewAddrFromPair("127.0.0.1", port), "u", socks.Rejected4},
+	}
+	for _, c := range cases {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		if err := socks.NewRequest4(socks.CmdConnect, c.addr, c.userID).Write(conn); err != nil {
+			t.Fatalf("Write request failed: %s", err)
+		}
+		reply, err := socks.ReadReply4(conn)
+		if err != nil {
+			t.Fatalf("Read reply failed: %s", err)
+		}
+		if reply.Rep != c.rep {
+			t.Fatalf("Reply of %s by %q got %#x, want %#x", c.addr, c.userID, reply.Rep, c.rep)
+		}
+		if c.rep == socks.Granted4 {
+			if b, _ := ioutil.ReadAll(conn); string(b) != "hello" {
+				t.Fatalf("Read got %q, want %q", b, "hello")
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestSocks4UserID(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		ioutil.ReadAll(conn)
+	}()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	// no authorization is required
+	cli := NewClient("127.0.0.1:1080")
+	cli.Rules, err = NewRulesFromMap(map[string]string{"*": "D"})
+	if err != nil {
+		t.Fatalf("Create rules failed: %s", err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go cli.socks4Handler(c2)
+	go socks.NewRequest4(socks.CmdConnect, socks.NewAddrFromPair("127.0.0.1", port), "admin:123456").Write(c1)
+	reply, err := socks.ReadReply4(c1)
+	if err != nil {
+		t.Fatalf("Read reply failed: %s", err)
+	}
+	if reply.Rep != socks.Granted4 {
+		t.Fatalf("Reply got %#x, want %#x", reply.Rep, socks.Granted4)
+	}
+	if _, err := io.ReadFull(c1, make([]byte, 5)); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	// the tunnel is recorded once it transports
+	list := cli.tunnels.List()
+	if len(list) != 1 || list[0].User != "admin" {
+		t.Fatalf("Tunnels got %+v, want one of user admin", list)
+	}
+}
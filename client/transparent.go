@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"log"
+	"net"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
+)
+
+func (c *Client) serveTransparent(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Acceptance failed: %s", err)
+			continue
+		}
+
+		go c.transparentHandler(conn)
+	}
+}
+
+// originalDst returns the destination conn is redirected from, tests
+// replace it to redirect without iptables
+var originalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("Not a TCP connection")
+	}
+	return getOriginalDst(tcpConn)
+}
+
+func (c *Client) transparentHandler(conn net.Conn) {
+	defer conn.Close()
+
+	dst, err := originalDst(conn)
+	if err != nil {
+		log.Printf(`[transparent] get original destination failed: %s`, err)
+		return
+	}
+	if dst.String() == conn.LocalAddr().String() {
+		// not redirected, connecting to itself would loop forever
+		log.Printf(`[transparent] connection from %s is not redirected`, conn.RemoteAddr())
+		return
+	}
+
+	addr, err := c.realAddr(socks.NewAddrFromPair(dst.IP.String(), dst.Port))
+	if err != nil {
+		log.Printf(`[transparent] %s %s from %s`, err, dst, conn.RemoteAddr())
+		return
+	}
+	ip := addr.Host
+	conn, host, addr := c.sniff(conn, addr)
+	host, rule := c.Rules.sniffedRule(ip, host, int(addr.Port))
+	nextHop, decision, err := c.dialRule("transparent", addr, host, rule, conn.RemoteAddr())
+	if err != nil {
+		if err != errRejected {
+			log.Printf(`[transparent] %s`, err)
+		}
+		return
+	}
+	defer nextHop.Close()
+
+	dash := dashOf(decision)
+
+	log.Printf(`[transparent] tunnel established %s <%c> %s`, conn.RemoteAddr(), dash, addr)
+	t := &tunnel.Tunnel{
+		Command:     "connect",
+		Source:      conn.RemoteAddr().String(),
+		Destination: addr.String(),
+		Rule:        decision,
+	}
+	if err := c.transport(t, conn, nextHop); err != nil {
+		log.Printf(`[transparent] transport failed: %s`, err)
+	}
+	log.Printf(`[transparent] tunnel disconnected %s >%c< %s`, conn.RemoteAddr(), dash, addr)
+}
@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// getOriginalDst returns the destination of a connection redirected by
+// iptables REDIRECT
+func getOriginalDst(conn *net.TCPConn) (dst *net.TCPAddr, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	isIPv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			// sockaddr_in fits in IPv6Mreq
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			b := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(b[2])<<8 | int(b[3]),
+			}
+		} else {
+			// sockaddr_in6 fits in IPv6MTUInfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port)) // network byte order
+			dst = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, serr
+}
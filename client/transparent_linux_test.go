@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// hasNetAdmin returns whether the process has CAP_NET_ADMIN
+func hasNetAdmin() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	for s := bufio.NewScanner(f); s.Scan(); {
+		if caps, ok := cutPrefixFold(s.Text(), "CapEff:"); ok {
+			c, err := strconv.ParseUint(strings.TrimSpace(caps), 16, 64)
+			return err == nil && c&(1<<12) != 0
+		}
+	}
+	return false
+}
+
+func TestGetOriginalDst(t *testing.T) {
+	// rules of iptables are added in a new network namespace, in which
+	// the test runs again
+	if os.Getenv("SUBSOCKS_TEST_NETNS") == "" {
+		if !hasNetAdmin() {
+			t.Skip("CAP_NET_ADMIN is required")
+		}
+		for _, name := range []string{"unshare", "ip", "iptables"} {
+			if _, err := exec.LookPath(name); err != nil {
+				t.Skipf("%s is required", name)
+			}
+		}
+		cmd := exec.Command("unshare", "--net", os.Args[0], "-test.run=^TestGetOriginalDst$")
+		cmd.Env = append(os.Environ(), "SUBSOCKS_TEST_NETNS=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Test in a network namespace failed: %s\n%s", err, out)
+		}
+		return
+	}
+
+	if out, err := exec.Command("ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+		t.Fatalf("Set up loopback failed: %s\n%s", err, out)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if out, err := exec.Command("iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp",
+		"-d", "127.0.0.2", "--dport", "80", "-j", "REDIRECT", "--to-ports", port).CombinedOutput(); err != nil {
+		t.Fatalf("Add iptables rule failed: %s\n%s", err, out)
+	}
+
+	cli, err := net.Dial("tcp", "127.0.0.2:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer cli.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	defer conn.Close()
+
+	dst, err := getOriginalDst(conn.(*net.TCPConn))
+	if err != nil {
+		t.Fatalf("Get original destination failed: %s", err)
+	}
+	if dst.String() != "127.0.0.2:80" {
+		t.Fatalf("Original destination got %s, want 127.0.0.2:80", dst)
+	}
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransparentHandler(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+
+	defer func(f func(net.Conn) (*net.TCPAddr, error)) { originalDst = f }(originalDst)
+
+	cases := []struct {
+		rules    map[string]string
+		redirect bool
+		want     string
+	}{
+		{map[string]string{"*": "D"}, true, "hello"},
+		{map[string]string{"127.0.0.1": "R", "*": "D"}, true, ""},
+		// connecting to itself would loop forever
+		{map[string]string{"*": "D"}, false, ""},
+	}
+
+	for _, c := range cases {
+		originalDst = func(conn net.Conn) (*net.TCPAddr, error) {
+			if !c.redirect {
+				return conn.LocalAddr().(*net.TCPAddr), nil
+			}
+			return target.Addr().(*net.TCPAddr), nil
+		}
+		cli := NewClient(ln.Addr().String())
+		cli.Rules, err = NewRulesFromMap(c.rules)
+		if err != nil {
+			t.Fatalf("Create rules failed: %s", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if conn, err := ln.Accept(); err == nil {
+				cli.transparentHandler(conn)
+			}
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		conn.(*net.TCPConn).CloseWrite()
+		b, err := ioutil.ReadAll(conn)
+		if err != nil || string(b) != c.want {
+			t.Fatalf("Read with rules %v and redirect %v got %q, %v, want %q", c.rules, c.redirect, b, err, c.want)
+		}
+		conn.Close()
+		<-done
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/luyuhuang/subsocks/tunnel"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+// openTunnel records the tunnel, closers are closed if it's closed by the
+// admin API
+func (c *Client) openTunnel(t *tunnel.Tunnel, closers ...io.Closer) {
+	tunnelsTotal.Inc(t.Command)
+	tunnelsActive.Inc(t.Command)
+	c.tunnels.Add(t, closers...)
+}
+
+func (c *Client) closeTunnel(t *tunnel.Tunnel) {
+	tunnelsActive.Dec(t.Command)
+	c.tunnels.Remove(t)
+}
+
+// transport transports conn1 and conn2 as the tunnel t, conn1 is the peer
+// that opens the tunnel
+func (c *Client) transport(t *tunnel.Tunnel, conn1, conn2 net.Conn) error {
+	c.openTunnel(t, conn1, conn2)
+	defer c.closeTunnel(t)
+
+	return utils.TransportCount(conn1, conn2,
+		func(n int) { countUp(t, n) },
+		func(n int) { countDown(t, n) })
+}
+
+func (c *Client) serveAdmin(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/tunnels", http.StripPrefix("/tunnels", c.tunnels))
+	mux.Handle("/tunnels/", http.StripPrefix("/tunnels", c.tunnels))
+	mux.HandleFunc("/proxy-cache", c.proxyCacheHandler)
+	mux.HandleFunc("/proxy-cache/", c.proxyCacheHandler)
+	if err := http.Serve(listener, tunnel.RequireToken(c.Config.AdminToken, mux)); err != nil {
+		log.Printf("Serve admin API failed: %s", err)
+	}
+}
+
+// proxyCacheHandler lists addresses in the auto-proxy cache by
+// "GET /proxy-cache", and removes one by "DELETE /proxy-cache/<addr>"
+func (c *Client) proxyCacheHandler(w http.ResponseWriter, req *http.Request) {
+	addr := strings.Trim(strings.TrimPrefix(req.URL.Path, "/proxy-cache"), "/")
+	if addr == "" {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Rules.proxyCache())
+		return
+	}
+
+	if req.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ok, err := c.Rules.removeProxyCache(addr)
+	if err != nil {
+		log.Printf("Remove %s from the proxy cache failed: %s", addr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,289 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luyuhuang/subsocks/metrics"
+	"github.com/luyuhuang/subsocks/mux"
+	"github.com/luyuhuang/subsocks/quic"
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+// Policies of choosing a server
+const (
+	PolicyFailover   = "failover"
+	PolicyRoundRobin = "round-robin"
+	PolicyLatency    = "latency"
+)
+
+// Upstream is a server the client connects to
+type Upstream struct {
+	latency int64 // nanoseconds of the last probe, accessed atomically
+	dead    int32 // accessed atomically
+
+	Group     string
+	Protocol  string
+	Addr      string
+	Username  string
+	Password  string
+	HTTPPath  string
+	WSPath    string
+	TLSConfig *tls.Config
+
+	muxMu       sync.Mutex
+	muxSessions []*mux.Session
+
+	h2Mu    sync.Mutex
+	h2Conns []*h2Conn
+
+	quicMu       sync.Mutex
+	quicSessions []*quic.Session
+}
+
+func (u *Upstream) String() string {
+	return u.Protocol + "://" + u.Addr
+}
+
+func (u *Upstream) isAlive() bool {
+	return atomic.LoadInt32(&u.dead) == 0
+}
+
+func (u *Upstream) setAlive(alive bool) {
+	var dead int32
+	if !alive {
+		dead = 1
+	}
+	if atomic.SwapInt32(&u.dead, dead) != dead {
+		if alive {
+			log.Printf("[upstream] server %s is up", u)
+		} else {
+			log.Printf("[upstream] server %s is down", u)
+		}
+	}
+}
+
+func (u *Upstream) getLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.latency))
+}
+
+var protocol2wrapper = map[string]func(*Upstream, net.Conn) net.Conn{
+	"https": (*Upstream).wrapHTTPS,
+	"http":  (*Upstream).wrapHTTP,
+	"socks": (*Upstream).wrapSocks,
+	"ws":    (*Upstream).wrapWS,
+	"wss":   (*Upstream).wrapWSS,
+	"h2":    (*Upstream).wrapH2,
+	"tls":   (*Upstream).wrapTLS,
+}
+
+// protocol2opener opens tunnels as streams of shared connections, instead
+// of dialing and wrapping a connection for each one
+var protocol2opener = map[string]func(*Upstream, time.Duration) (net.Conn, error){
+	"h2":   (*Upstream).openH2Stream,
+	"quic": (*Upstream).openQUICStream,
+}
+
+// groupServers returns servers of the group. The default group contains
+// servers not in any group, or all servers if every server is in a group.
+func (c *Client) groupServers(group string) []*Upstream {
+	var servers []*Upstream
+	for _, u := range c.Config.Servers {
+		if u.Group == group {
+			servers = append(servers, u)
+		}
+	}
+	if group == "" && len(servers) == 0 {
+		return c.Config.Servers
+	}
+	return servers
+}
+
+// upstreams returns servers of the group in the order they should be tried
+func (c *Client) upstreams(group string) []*Upstream {
+	servers := c.groupServers(group)
+	n := len(servers)
+
+	start := 0
+	if c.Config.Policy == PolicyRoundRobin && n > 0 {
+		c.nextMu.Lock()
+		if c.next == nil {
+			c.next = make(map[string]int)
+		}
+		start = c.next[group] % n
+		c.next[group] = start + 1
+		c.nextMu.Unlock()
+	}
+
+	alive := make([]*Upstream, 0, n)
+	var dead []*Upstream
+	for i := 0; i < n; i++ {
+		u := servers[(start+i)%n]
+		if u.isAlive() {
+			alive = append(alive, u)
+		} else {
+			dead = append(dead, u)
+		}
+	}
+
+	if c.Config.Policy == PolicyLatency {
+		sort.SliceStable(alive, func(i, j int) bool {
+			return alive[i].getLatency() < alive[j].getLatency()
+		})
+	}
+
+	// dead servers are the last resort
+	return append(alive, dead...)
+}
+
+func (c *Client) dialServer() (net.Conn, error) {
+	return c.dialGroup("")
+}
+
+// dialGroup dials a server of the group, empty for the default group
+func (c *Client) dialGroup(group string) (net.Conn, error) {
+	return c.dialGroupMux(group, c.Config.Mux)
+}
+
+// dialGroupMux is the same as dialGroup, except that it opens streams of
+// mux sessions only if useMux is true
+func (c *Client) dialGroupMux(group string, useMux bool) (conn net.Conn, err error) {
+	servers := c.upstreams(group)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No server in group %q", group)
+	}
+
+	for _, u := range servers {
+		if useMux {
+			conn, err = c.openStream(u)
+		} else {
+			conn, err = dialUpstream(u, c.Config.ServerDialTimeout)
+		}
+		if err == nil {
+			u.setAlive(true)
+			return
+		}
+
+		log.Printf("[upstream] dial server %s failed: %s", u, err)
+		dialFailures.Inc("server", metrics.ErrReason(err))
+		u.setAlive(false)
+	}
+	return
+}
+
+// dialUpstream connects to the server and finishes the socks5 handshake,
+// it fails if it takes longer than timeout when timeout is not zero.
+func dialUpstream(u *Upstream, timeout time.Duration) (net.Conn, error) {
+	wrapper, ok := protocol2wrapper[u.Protocol]
+	open, shared := protocol2opener[u.Protocol]
+	if !ok && !shared {
+		return nil, errors.New("Unknow protocol")
+	}
+
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if shared {
+		conn, err = open(u, timeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", u.Addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if !shared {
+		conn = wrapper(u, conn)
+	}
+
+	// handshake
+	if err := handshake(u, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	handshakeSeconds.Observe(time.Since(start).Seconds(), u.String())
+	return conn, nil
+}
+
+// socksAuth tells protocols authorizing by socks5 rather than HTTP
+var socksAuth = map[string]bool{
+	"socks": true,
+	"tls":   true,
+	"quic":  true,
+}
+
+func handshake(u *Upstream, conn net.Conn) error {
+	methods := []byte{socks.MethodNoAuth}
+	// socks, tls and quic authorize by socks5, other protocols by HTTP
+	if socksAuth[u.Protocol] && u.Username != "" && u.Password != "" {
+		methods = append(methods, socks.MethodUserPass)
+	}
+	if err := socks.WriteMethods(methods, conn); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks.Version || !bytes.Contains(methods, buf[1:]) {
+		return errors.New("Handshake failed")
+	}
+
+	if buf[1] == socks.MethodUserPass {
+		req := socks.NewUserPassRequest(socks.UserPassVer, u.Username, u.Password)
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		res, err := socks.ReadUserPassResponse(conn)
+		if err != nil {
+			return err
+		}
+		if res.Status != 0 {
+			return errors.New("Authorization failed")
+		}
+	}
+	return nil
+}
+
+func (c *Client) healthCheck() {
+	ticker := time.NewTicker(c.Config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, u := range c.Config.Servers {
+			go c.probe(u)
+		}
+		<-ticker.C
+	}
+}
+
+func (c *Client) probe(u *Upstream) {
+	start := time.Now()
+	conn, err := dialUpstream(u, c.Config.HealthCheckTimeout)
+	if err != nil {
+		if u.isAlive() {
+			log.Printf("[upstream] probe server %s failed: %s", u, err)
+		}
+		u.setAlive(false)
+		return
+	}
+	conn.Close()
+
+	atomic.StoreInt64(&u.latency, int64(time.Since(start)))
+	u.setAlive(true)
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func TestUpstreamsOrder(t *testing.T) {
+	a := &Upstream{Protocol: "socks", Addr: "a:1080"}
+	b := &Upstream{Protocol: "socks", Addr: "b:1080"}
+	c := &Upstream{Protocol: "socks", Addr: "c:1080"}
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Servers = []*Upstream{a, b, c}
+
+	cases := []struct {
+		policy  string
+		dead    []*Upstream
+		latency []time.Duration
+		want    [][]*Upstream
+	}{
+		{PolicyFailover, nil, nil, [][]*Upstream{{a, b, c}, {a, b, c}}},
+		{PolicyFailover, []*Upstream{a}, nil, [][]*Upstream{{b, c, a}}},
+		{PolicyRoundRobin, nil, nil, [][]*Upstream{{a, b, c}, {b, c, a}, {c, a, b}, {a, b, c}}},
+		{PolicyRoundRobin, []*Upstream{b}, nil, [][]*Upstream{{a, c, b}, {c, a, b}, {c, a, b}}},
+		{PolicyLatency, nil, []time.Duration{3, 1, 2}, [][]*Upstream{{b, c, a}}},
+		{PolicyLatency, []*Upstream{b}, []time.Duration{3, 1, 2}, [][]*Upstream{{c, a, b}}},
+	}
+
+	for _, c := range cases {
+		cli.Config.Policy = c.policy
+		cli.next = nil
+		for i, u := range cli.Config.Servers {
+			u.dead = 0
+			u.latency = 0
+			if c.latency != nil {
+				u.latency = int64(c.latency[i])
+			}
+		}
+		for _, u := range c.dead {
+			u.dead = 1
+		}
+
+		for _, want := range c.want {
+			got := cli.upstreams("")
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("Policy %s order got %v, want %v", c.policy, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestGroupServers(t *testing.T) {
+	a := &Upstream{Protocol: "socks", Addr: "a:1080"}
+	b := &Upstream{Protocol: "socks", Addr: "b:1080", Group: "office"}
+	c := &Upstream{Protocol: "socks", Addr: "c:1080", Group: "office"}
+	d := &Upstream{Protocol: "socks", Addr: "d:1080", Group: "us-east"}
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Policy = PolicyRoundRobin
+	cli.Config.Servers = []*Upstream{a, b, c, d}
+
+	cases := []struct {
+		group string
+		want  []*Upstream
+	}{
+		{"", []*Upstream{a}},
+		{"office", []*Upstream{b, c}},
+		{"us-east", []*Upstream{d}},
+		{"office", []*Upstream{c, b}},
+		{"", []*Upstream{a}},
+		{"office", []*Upstream{b, c}},
+		{"none", nil},
+	}
+	for _, c := range cases {
+		got := cli.upstreams(c.group)
+		if len(got) != len(c.want) {
+			t.Fatalf("Group %q servers got %v, want %v", c.group, got, c.want)
+		}
+		for i := range c.want {
+			if got[i] != c.want[i] {
+				t.Fatalf("Group %q servers got %v, want %v", c.group, got, c.want)
+			}
+		}
+	}
+
+	// all servers are in groups
+	cli.Config.Servers = []*Upstream{b, d}
+	if got := cli.upstreams(""); len(got) != 2 {
+		t.Fatalf("Default group servers got %v, want %v", got, cli.Config.Servers)
+	}
+}
+
+func TestDialServerFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			socks.ReadMethods(conn)
+			socks.WriteMethod(socks.MethodNoAuth, conn)
+			io.Copy(conn, conn)
+		}
+	}()
+
+	// take a free port then release it so that nothing listens on it
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	down := &Upstream{Protocol: "socks", Addr: closed.Addr().String()}
+	up := &Upstream{Protocol: "socks", Addr: ln.Addr().String()}
+
+	cli := NewClient("127.0.0.1:1030")
+	cli.Config.Policy = PolicyFailover
+	cli.Config.Servers = []*Upstream{down, up}
+
+	conn, err := cli.dialServer()
+	if err != nil {
+		t.Fatalf("Dial server failed: %s", err)
+	}
+	conn.Close()
+
+	if down.isAlive() {
+		t.Fatalf("Server %s should be down", down)
+	}
+	if !up.isAlive() {
+		t.Fatalf("Server %s should be up", up)
+	}
+	if got := cli.upstreams("")[0]; got != up {
+		t.Fatalf("First server got %s, want %s", got, up)
+	}
+}
@@ -12,28 +12,28 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func (c *Client) wrapWSS(conn net.Conn) net.Conn {
-	return c.wrapWS(tls.Client(conn, c.TLSConfig))
+func (u *Upstream) wrapWSS(conn net.Conn) net.Conn {
+	return u.wrapWS(tls.Client(conn, u.TLSConfig))
 }
 
-func (c *Client) wrapWS(conn net.Conn) net.Conn {
-	return newWSWrapper(conn, c)
+func (u *Upstream) wrapWS(conn net.Conn) net.Conn {
+	return newWSWrapper(conn, u)
 }
 
 type wsWrapper struct {
 	net.Conn
-	client *Client
-	buf    *bytes.Buffer
+	upstream *Upstream
+	buf      *bytes.Buffer
 
 	wsConn *websocket.Conn
 }
 
-func newWSWrapper(conn net.Conn, client *Client) *wsWrapper {
+func newWSWrapper(conn net.Conn, upstream *Upstream) *wsWrapper {
 	return &wsWrapper{
-		Conn:   conn,
-		client: client,
-		buf:    bytes.NewBuffer(make([]byte, 0, 1024)),
-		wsConn: nil,
+		Conn:     conn,
+		upstream: upstream,
+		buf:      bytes.NewBuffer(make([]byte, 0, 1024)),
+		wsConn:   nil,
 	}
 }
 
@@ -75,17 +75,17 @@ func (w *wsWrapper) Write(b []byte) (n int, err error) {
 }
 
 func (w *wsWrapper) handshake() (conn *websocket.Conn, err error) {
-	config := w.client.Config
-	log.Printf("[websocket] upgrade to websocket at %s", config.WSPath)
+	upstream := w.upstream
+	log.Printf("[websocket] upgrade to websocket at %s", upstream.WSPath)
 	u := url.URL{
 		Scheme: "ws",
-		Host:   config.ServerAddr,
-		Path:   config.WSPath,
+		Host:   upstream.Addr,
+		Path:   upstream.WSPath,
 	}
 	var header http.Header
-	if config.Username != "" && config.Password != "" {
+	if upstream.Username != "" && upstream.Password != "" {
 		header = make(http.Header)
-		s := base64.StdEncoding.EncodeToString([]byte(config.Username + ":" + config.Password))
+		s := base64.StdEncoding.EncodeToString([]byte(upstream.Username + ":" + upstream.Password))
 		header.Add("Authorization", "Basic "+s)
 	}
 	conn, res, err := websocket.NewClient(w.Conn, &u, header, 0, 0)
@@ -1,10 +1,26 @@
 module github.com/luyuhuang/subsocks
 
-go 1.15
+go 1.21
 
 require (
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/gorilla/websocket v1.4.2
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/pelletier/go-toml v1.8.1
+	github.com/quic-go/quic-go v0.46.0
 	github.com/tg123/go-htpasswd v1.0.0
+	golang.org/x/net v0.25.0
+)
+
+require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/crypto v0.23.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/text v0.15.0 // indirect
+	golang.org/x/tools v0.21.0 // indirect
 )
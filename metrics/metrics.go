@@ -0,0 +1,318 @@
+// Package metrics implements counters, gauges and histograms that are
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter registers a counter with the label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", labels, nil)}
+}
+
+// NewGauge registers a gauge with the label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", labels, nil)}
+}
+
+// NewHistogram registers a histogram with the upper bounds of buckets and
+// the label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(name, help, "histogram", labels, buckets)}
+}
+
+func (r *Registry) register(name, help, typ string, labels []string, buckets []float64) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	if len(labels) == 0 {
+		m.get(nil)
+	}
+
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+	return m
+}
+
+// WriteTo writes all metrics to w in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	m *metric
+}
+
+// Add adds v to the counter with the label values
+func (c *Counter) Add(v float64, labels ...string) {
+	c.m.get(labels).value.add(v)
+}
+
+// Inc increases the counter with the label values by 1
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	m *metric
+}
+
+// Set sets the gauge with the label values to v
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.m.get(labels).value.set(v)
+}
+
+// Add adds v to the gauge with the label values
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.m.get(labels).value.add(v)
+}
+
+// Inc increases the gauge with the label values by 1
+func (g *Gauge) Inc(labels ...string) {
+	g.Add(1, labels...)
+}
+
+// Dec decreases the gauge with the label values by 1
+func (g *Gauge) Dec(labels ...string) {
+	g.Add(-1, labels...)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	m *metric
+}
+
+// Observe adds an observation to the histogram with the label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	s := h.m.get(labels)
+	for i, upper := range h.m.buckets {
+		if v <= upper {
+			s.buckets[i].add(1)
+		}
+	}
+	s.value.add(v)
+	s.count.add(1)
+}
+
+// ErrReason classifies a dial error into a short reason for labels
+func ErrReason(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "resolve"
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return "timeout"
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "refused"
+	}
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+		return "unreachable"
+	}
+	return "other"
+}
+
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	// atomically updated values go first to be 64-bit aligned
+	value   float
+	count   float
+	buckets []float
+	labels  []string
+}
+
+func (m *metric) get(labels []string) *series {
+	if len(labels) != len(m.labels) {
+		panic("metrics: " + m.name + " got " + strconv.Itoa(len(labels)) +
+			" label values, want " + strconv.Itoa(len(m.labels)))
+	}
+	key := strings.Join(labels, "\xff")
+
+	m.mu.RLock()
+	s, ok := m.series[key]
+	m.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+	s = &series{
+		labels:  append([]string(nil), labels...),
+		buckets: make([]float, len(m.buckets)),
+	}
+	m.series[key] = s
+	return s
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	all := make([]*series, len(keys))
+	for i, k := range keys {
+		all[i] = m.series[k]
+	}
+	m.mu.RUnlock()
+
+	w.WriteString("# HELP " + m.name + " " + escape(m.help, false) + "\n")
+	w.WriteString("# TYPE " + m.name + " " + m.typ + "\n")
+	for _, s := range all {
+		if m.typ != "histogram" {
+			writeSample(w, m.name, m.labels, s.labels, "", "", s.value.get())
+			continue
+		}
+		for i, upper := range m.buckets {
+			writeSample(w, m.name+"_bucket", m.labels, s.labels, "le", formatFloat(upper), s.buckets[i].get())
+		}
+		count := s.count.get()
+		writeSample(w, m.name+"_bucket", m.labels, s.labels, "le", "+Inf", count)
+		writeSample(w, m.name+"_sum", m.labels, s.labels, "", "", s.value.get())
+		writeSample(w, m.name+"_count", m.labels, s.labels, "", "", count)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, names, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(names) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, n := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(n + `="` + escape(values[i], true) + `"`)
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escape(s string, quote bool) string {
+	if quote {
+		return labelEscaper.Replace(s)
+	}
+	return helpEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// float is a float64 that's updated atomically
+type float struct {
+	bits uint64
+}
+
+func (f *float) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func (f *float) set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *float) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		new := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, new) {
+			return
+		}
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_requests_total", "Number of requests.", "method", "code")
+	g := r.NewGauge("test_active", "Active connections.")
+	h := r.NewHistogram("test_seconds", "Latency.", []float64{0.1, 1}, "server")
+
+	c.Inc("get", "200")
+	c.Add(2, "get", "200")
+	c.Inc("post", "5\"0\\0\n")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h.Observe(0.05, "a")
+	h.Observe(0.5, "a")
+	h.Observe(5, "a")
+
+	want := `# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{method="get",code="200"} 3
+test_requests_total{method="post",code="5\"0\\0\n"} 1
+# HELP test_active Active connections.
+# TYPE test_active gauge
+test_active 1
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{server="a",le="0.1"} 1
+test_seconds_bucket{server="a",le="1"} 2
+test_seconds_bucket{server="a",le="+Inf"} 3
+test_seconds_sum{server="a"} 5.55
+test_seconds_count{server="a"} 3
+`
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("Write metrics failed: %s", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("Written bytes got %d, want %d", n, buf.Len())
+	}
+	if buf.String() != want {
+		t.Fatalf("Metrics got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "a")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Wrong number of label values should panic")
+		}
+	}()
+	c.Inc("x", "y")
+}
+
+func TestErrReason(t *testing.T) {
+	cases := []struct {
+		err    error
+		reason string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, "resolve"},
+		{&net.OpError{Op: "dial", Err: &timeoutError{}}, "timeout"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, "unreachable"},
+		{errors.New("Unknow protocol"), "other"},
+	}
+
+	for _, c := range cases {
+		if reason := ErrReason(c.err); reason != c.reason {
+			t.Fatalf("Reason of %q got %q, want %q", c.err, reason, c.reason)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
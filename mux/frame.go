@@ -0,0 +1,71 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Version of the multiplexing protocol
+const Version = 1
+
+// Commands
+const (
+	cmdSYN uint8 = iota // open a stream
+	cmdPSH              // push data
+	cmdFIN              // half-close, no more data from the sender
+	cmdRST              // reset, the stream is gone
+	cmdUPD              // window update
+	cmdNOP              // keepalive
+)
+
+const headerSize = 8
+
+// maxPayload is the largest payload a single frame carries
+const maxPayload = 32 * 1024
+
+/*
+frame is the unit of the session
+
+	+-----+-----+--------+-----------+----------+
+	| VER | CMD | LENGTH | STREAM ID |   DATA   |
+	+-----+-----+--------+-----------+----------+
+	|  1  |  1  |   2    |     4     | Variable |
+	+-----+-----+--------+-----------+----------+
+*/
+type frame struct {
+	cmd  uint8
+	sid  uint32
+	data []byte
+}
+
+func newFrame(cmd uint8, sid uint32, data []byte) *frame {
+	return &frame{
+		cmd:  cmd,
+		sid:  sid,
+		data: data,
+	}
+}
+
+func readFrameHeader(r io.Reader, b []byte) (cmd uint8, sid uint32, length int, err error) {
+	if _, err = io.ReadFull(r, b[:headerSize]); err != nil {
+		return
+	}
+	if b[0] != Version {
+		err = ErrBadVersion
+		return
+	}
+	cmd = b[1]
+	length = int(binary.BigEndian.Uint16(b[2:4]))
+	sid = binary.BigEndian.Uint32(b[4:8])
+	return
+}
+
+func (f *frame) encode() []byte {
+	b := make([]byte, headerSize+len(f.data))
+	b[0] = Version
+	b[1] = f.cmd
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(f.data)))
+	binary.BigEndian.PutUint32(b[4:8], f.sid)
+	copy(b[headerSize:], f.data)
+	return b
+}
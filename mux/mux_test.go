@@ -0,0 +1,221 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSessionPair() (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	config := DefaultConfig()
+	config.Window = 1024
+	return Client(c1, config), Server(c2, config)
+}
+
+func TestStreamEcho(t *testing.T) {
+	cli, ser := newSessionPair()
+	defer cli.Close()
+	defer ser.Close()
+
+	go func() {
+		for {
+			st, err := ser.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	cases := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("abcdefg"), 1000), // larger than the window
+		bytes.Repeat([]byte{0}, maxPayload*3),
+	}
+
+	done := make(chan error, len(cases))
+	for _, c := range cases {
+		c := c
+		go func() {
+			st, err := cli.Open()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer st.Close()
+
+			go func() {
+				st.Write(c)
+				st.CloseWrite()
+			}()
+			b, err := ioutil.ReadAll(st)
+			if err != nil {
+				done <- err
+				return
+			}
+			if !bytes.Equal(b, c) {
+				t.Errorf("Echo got %d bytes, want %d bytes", len(b), len(c))
+			}
+			done <- nil
+		}()
+	}
+
+	for range cases {
+		if err := <-done; err != nil {
+			t.Fatalf("Stream failed: %s", err)
+		}
+	}
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	cli, ser := newSessionPair()
+	defer cli.Close()
+	defer ser.Close()
+
+	st, err := cli.Open()
+	if err != nil {
+		t.Fatalf("Open stream failed: %s", err)
+	}
+	peer, err := ser.Accept()
+	if err != nil {
+		t.Fatalf("Accept stream failed: %s", err)
+	}
+
+	st.Write([]byte("request"))
+	st.CloseWrite()
+
+	b, err := ioutil.ReadAll(peer)
+	if err != nil || string(b) != "request" {
+		t.Fatalf("Read got %q, %v, want %q", b, err, "request")
+	}
+
+	// the other direction is still open
+	if _, err := peer.Write([]byte("response")); err != nil {
+		t.Fatalf("Write after half-close failed: %s", err)
+	}
+	peer.Close()
+
+	b, err = ioutil.ReadAll(st)
+	if err != nil || string(b) != "response" {
+		t.Fatalf("Read got %q, %v, want %q", b, err, "response")
+	}
+	if _, err := st.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("Write after CloseWrite got %v, want %v", err, io.ErrClosedPipe)
+	}
+	st.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	if n := cli.NumStreams(); n != 0 {
+		t.Fatalf("Client streams got %d, want 0", n)
+	}
+	if n := ser.NumStreams(); n != 0 {
+		t.Fatalf("Server streams got %d, want 0", n)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	cli, ser := newSessionPair()
+	defer cli.Close()
+	defer ser.Close()
+
+	st, _ := cli.Open()
+	peer, _ := ser.Accept()
+
+	// the peer closes without reading, the writer must not block forever
+	peer.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := st.Write(bytes.Repeat([]byte{1}, 4096)); err != ErrStreamReset {
+		t.Fatalf("Write got %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := st.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	c1, c2 := net.Pipe()
+	config := DefaultConfig()
+	config.Window = 1024
+	ser := Server(c2, config)
+	defer ser.Close()
+	defer c1.Close()
+
+	// the peer sends more than the window without waiting for updates
+	rst := make(chan uint32, 1)
+	go func() {
+		b := make([]byte, headerSize+65535)
+		for {
+			cmd, sid, length, err := readFrameHeader(c1, b)
+			if err == nil {
+				_, err = io.ReadFull(c1, b[:length])
+			}
+			if err != nil {
+				return
+			}
+			if cmd == cmdRST {
+				rst <- sid
+			}
+		}
+	}()
+	c1.Write(newFrame(cmdSYN, 1, nil).encode())
+	c1.Write(newFrame(cmdPSH, 1, bytes.Repeat([]byte{1}, 1024)).encode())
+	c1.Write(newFrame(cmdPSH, 1, []byte{1}).encode())
+
+	select {
+	case sid := <-rst:
+		if sid != 1 {
+			t.Fatalf("Reset stream got %d, want 1", sid)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Stream isn't reset")
+	}
+
+	st, err := ser.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	b, err := ioutil.ReadAll(st)
+	if len(b) != 1024 || err != ErrWindowExceeded {
+		t.Fatalf("Read got %d bytes, %v, want 1024 bytes, %v", len(b), err, ErrWindowExceeded)
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	cli, ser := newSessionPair()
+	defer cli.Close()
+	defer ser.Close()
+
+	st, _ := cli.Open()
+	st.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := st.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("Read got %v, want timeout", err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	cli, ser := newSessionPair()
+
+	st, _ := cli.Open()
+	ser.Accept()
+	ser.Close()
+
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Read after session closed got nil error")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !cli.IsClosed() {
+		t.Fatalf("Client session is not closed")
+	}
+	if _, err := cli.Open(); err != ErrSessionClosed {
+		t.Fatalf("Open got %v, want %v", err, ErrSessionClosed)
+	}
+}
@@ -0,0 +1,282 @@
+// Package mux carries many logical streams inside one connection. Every
+// stream has its own flow control window and can be half-closed.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors
+var (
+	ErrBadVersion     = errors.New("Bad version")
+	ErrSessionClosed  = errors.New("Session closed")
+	ErrStreamReset    = errors.New("Stream reset")
+	ErrWindowExceeded = errors.New("Receive window exceeded")
+	ErrTimeout        = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Config is the session configuration
+type Config struct {
+	// Window is the receive window of each stream in bytes
+	Window uint32
+	// Backlog is the number of streams waiting to be accepted
+	Backlog int
+	// KeepAliveInterval is the interval of sending keepalive frames
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout closes the session if nothing is received in this duration
+	KeepAliveTimeout time.Duration
+}
+
+// DefaultConfig returns the default session configuration
+func DefaultConfig() *Config {
+	return &Config{
+		Window:            256 * 1024,
+		Backlog:           1024,
+		KeepAliveInterval: 30 * time.Second,
+		KeepAliveTimeout:  90 * time.Second,
+	}
+}
+
+// Session multiplexes streams over a connection
+type Session struct {
+	lastRecv int64 // accessed atomically, keep it 64-bit aligned
+
+	conn   net.Conn
+	config *Config
+
+	nextID  uint32
+	streams map[uint32]*Stream
+	mu      sync.Mutex
+	writeMu sync.Mutex
+
+	accepts chan *Stream
+
+	die     chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+}
+
+// Client creates the session on the side opening streams
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server creates the session on the side accepting streams
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config *Config, nextID uint32) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	s := &Session{
+		conn:     conn,
+		config:   config,
+		nextID:   nextID,
+		streams:  make(map[uint32]*Stream),
+		accepts:  make(chan *Stream, config.Backlog),
+		lastRecv: time.Now().UnixNano(),
+		die:      make(chan struct{}),
+	}
+	go s.recvLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+// Open opens a new stream
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	sid := s.nextID
+	s.nextID += 2
+	st := newStream(s, sid)
+	s.streams[sid] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(newFrame(cmdSYN, sid, nil)); err != nil {
+		s.removeStream(sid)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.dieErr
+	}
+}
+
+// NumStreams returns the number of active streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed returns whether the session is closed
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that's closed when the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.die
+}
+
+// Close closes the session and all its streams
+func (s *Session) Close() error {
+	return s.closeWithError(ErrSessionClosed)
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) closeWithError(err error) error {
+	closed := false
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.die)
+		closed = true
+	})
+	if !closed {
+		return nil
+	}
+
+	s.mu.Lock()
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mu.Unlock()
+	for _, st := range streams {
+		st.reset(err)
+	}
+	return s.conn.Close()
+}
+
+func (s *Session) removeStream(sid uint32) {
+	s.mu.Lock()
+	delete(s.streams, sid)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(f *frame) error {
+	if s.IsClosed() {
+		return s.dieErr
+	}
+	s.writeMu.Lock()
+	_, err := s.conn.Write(f.encode())
+	s.writeMu.Unlock()
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+func (s *Session) recvLoop() {
+	b := make([]byte, headerSize+65535)
+	for {
+		cmd, sid, length, err := readFrameHeader(s.conn, b)
+		if err == nil {
+			_, err = io.ReadFull(s.conn, b[:length])
+		}
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+		s.mu.Lock()
+		st := s.streams[sid]
+		s.mu.Unlock()
+
+		switch cmd {
+		case cmdSYN:
+			if st != nil {
+				continue
+			}
+			st = newStream(s, sid)
+			s.mu.Lock()
+			s.streams[sid] = st
+			s.mu.Unlock()
+			select {
+			case s.accepts <- st:
+			default: // backlog is full
+				s.removeStream(sid)
+				s.writeFrame(newFrame(cmdRST, sid, nil))
+			}
+		case cmdPSH:
+			if st != nil && !st.push(b[:length]) {
+				// the peer ignores flow control, drop the stream rather
+				// than buffering without limit
+				s.removeStream(sid)
+				st.reset(ErrWindowExceeded)
+				s.writeFrame(newFrame(cmdRST, sid, nil))
+			}
+		case cmdUPD:
+			if st != nil && length >= 4 {
+				st.grow(binary.BigEndian.Uint32(b[:4]))
+			}
+		case cmdFIN:
+			if st != nil {
+				st.remoteFin()
+			}
+		case cmdRST:
+			if st != nil {
+				s.removeStream(sid)
+				st.reset(ErrStreamReset)
+			}
+		case cmdNOP:
+		}
+	}
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastRecv))
+			if s.config.KeepAliveTimeout > 0 && time.Since(last) > s.config.KeepAliveTimeout {
+				s.closeWithError(ErrTimeout)
+				return
+			}
+			s.writeFrame(newFrame(cmdNOP, 0, nil))
+		case <-s.die:
+			return
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection inside a session. It implements net.Conn
+type Stream struct {
+	sess *Session
+	id   uint32
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	consumed   uint32 // bytes read but not acknowledged to the peer
+	recvWindow uint32 // bytes the peer may send before acknowledged
+	sendWindow uint32
+	eof        bool  // the peer sent FIN
+	finSent    bool  // we sent FIN
+	closed     bool  // closed locally
+	err        error // reset
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(sess *Session, id uint32) *Stream {
+	return &Stream{
+		sess:       sess,
+		id:         id,
+		recvWindow: sess.config.Window,
+		sendWindow: sess.config.Window,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream ID
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ = st.buf.Read(b)
+			st.consumed += uint32(n)
+			var upd uint32
+			if st.consumed >= st.sess.config.Window/2 {
+				upd, st.consumed = st.consumed, 0
+				st.recvWindow += upd
+			}
+			eof := st.eof
+			st.mu.Unlock()
+
+			if upd > 0 && !eof {
+				data := make([]byte, 4)
+				binary.BigEndian.PutUint32(data, upd)
+				st.sess.writeFrame(newFrame(cmdUPD, st.id, data))
+			}
+			return
+		}
+		if st.eof {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.err != nil {
+			err = st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err = wait(st.readEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.mu.Lock()
+		if st.closed || st.finSent {
+			st.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if st.err != nil {
+			err = st.err
+			st.mu.Unlock()
+			return n, err
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err = wait(st.writeEvent, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		size := len(b)
+		if size > maxPayload {
+			size = maxPayload
+		}
+		if uint32(size) > st.sendWindow {
+			size = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(size)
+		st.mu.Unlock()
+
+		if err = st.sess.writeFrame(newFrame(cmdPSH, st.id, b[:size])); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// CloseWrite half-closes the stream, the peer will read EOF after all data
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.finSent || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.eof
+	st.mu.Unlock()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	return st.sess.writeFrame(newFrame(cmdFIN, st.id, nil))
+}
+
+// Close closes the stream in both directions
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFin := !st.finSent && st.err == nil
+	sendRst := !st.eof && st.err == nil
+	st.finSent = true
+	st.mu.Unlock()
+
+	notify(st.readEvent)
+	notify(st.writeEvent)
+	st.sess.removeStream(st.id)
+
+	var err error
+	if sendFin {
+		err = st.sess.writeFrame(newFrame(cmdFIN, st.id, nil))
+	}
+	if sendRst && err == nil {
+		err = st.sess.writeFrame(newFrame(cmdRST, st.id, nil))
+	}
+	return err
+}
+
+// LocalAddr returns the local address of the session
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+// SetDeadline sets both the read and write deadlines
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readEvent)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeEvent)
+	return nil
+}
+
+// push buffers data from the peer, it returns false if the data exceeds
+// the receive window
+func (st *Stream) push(data []byte) bool {
+	st.mu.Lock()
+	if uint32(len(data)) > st.recvWindow {
+		st.mu.Unlock()
+		return false
+	}
+	st.recvWindow -= uint32(len(data))
+	if !st.closed {
+		st.buf.Write(data)
+	}
+	st.mu.Unlock()
+	notify(st.readEvent)
+	return true
+}
+
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writeEvent)
+}
+
+func (st *Stream) remoteFin() {
+	st.mu.Lock()
+	st.eof = true
+	done := st.finSent
+	st.mu.Unlock()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	notify(st.readEvent)
+}
+
+func (st *Stream) reset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readEvent)
+	notify(st.writeEvent)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return ErrTimeout
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
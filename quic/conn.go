@@ -0,0 +1,170 @@
+package quic
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// datagramBacklog is the number of datagrams of a stream waiting to be read,
+// more ones are dropped
+const datagramBacklog = 128
+
+// Conn is a stream of a session, it implements net.Conn
+type Conn struct {
+	quicgo.Stream
+	sess *Session
+
+	dgrams    chan []byte
+	done      chan struct{} // the stream is finished, after datagrams begin
+	err       error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(sess *Session, stream quicgo.Stream) *Conn {
+	return &Conn{
+		Stream: stream,
+		sess:   sess,
+		dgrams: make(chan []byte, datagramBacklog),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Close closes the stream in both directions
+func (c *Conn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.sess.removeStream(c.StreamID())
+		c.CancelRead(0)
+		err = c.Stream.Close()
+	})
+	return
+}
+
+// LocalAddr returns the local address of the session
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sess.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.sess.conn.RemoteAddr()
+}
+
+// Datagrams returns a connection of SOCKS5 UDP datagrams whose RSV is the
+// length of data. Every write is a datagram sent as a QUIC datagram, or on
+// the stream if it's too large. The stream can't be used directly then.
+func (c *Conn) Datagrams() net.Conn {
+	go c.readDatagrams()
+	return &datagramConn{Conn: c}
+}
+
+func (c *Conn) pushDatagram(b []byte) {
+	select {
+	case c.dgrams <- b:
+	default:
+	}
+}
+
+// readDatagrams reads datagrams too large to be sent as QUIC datagrams
+// from the stream
+func (c *Conn) readDatagrams() {
+	for {
+		dgram, err := socks.ReadUDPDatagram(c.Stream)
+		if err != nil {
+			c.err = err
+			close(c.done)
+			return
+		}
+		buf := bytes.NewBuffer(nil)
+		dgram.Write(buf)
+		select {
+		case c.dgrams <- buf.Bytes():
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+type datagramConn struct {
+	*Conn
+	buf []byte
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (d *datagramConn) Read(b []byte) (n int, err error) {
+	if len(d.buf) == 0 {
+		if d.buf, err = d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return
+}
+
+// next returns the next datagram
+func (d *datagramConn) next() ([]byte, error) {
+	d.mu.Lock()
+	deadline := d.deadline
+	d.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case b := <-d.dgrams:
+		return b, nil
+	case <-d.done:
+		select {
+		case b := <-d.dgrams:
+			return b, nil
+		default:
+			return nil, d.err
+		}
+	case <-d.closed:
+		return nil, net.ErrClosed
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (d *datagramConn) Write(b []byte) (int, error) {
+	err := d.sess.sendDatagram(d.StreamID(), b)
+	var tooLarge *quicgo.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return d.Stream.Write(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetDeadline sets the read and write deadlines
+func (d *datagramConn) SetDeadline(t time.Time) error {
+	d.SetReadDeadline(t)
+	return d.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (d *datagramConn) SetReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.deadline = t
+	d.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,91 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// ErrListenerClosed is returned by Accept after the listener is closed
+var ErrListenerClosed = errors.New("Listener closed")
+
+// Listener accepts streams of all QUIC connections, it implements
+// net.Listener
+type Listener struct {
+	ln    *quicgo.Listener
+	conns chan net.Conn
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// Listen listens for QUIC connections on the UDP address
+func Listen(addr string, config *tls.Config) (*Listener, error) {
+	ln, err := quicgo.ListenAddr(addr, tlsConfig(config), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{
+		ln:    ln,
+		conns: make(chan net.Conn),
+		die:   make(chan struct{}),
+	}
+	go l.acceptSessions()
+	return l, nil
+}
+
+func (l *Listener) acceptSessions() {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		go l.acceptStreams(newSession(conn))
+	}
+}
+
+func (l *Listener) acceptStreams(s *Session) {
+	for {
+		stream, err := s.conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		c := s.addStream(stream)
+		select {
+		case l.conns <- c:
+		case <-l.die:
+			c.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next stream
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.die:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops listening and closes all connections
+func (l *Listener) Close() error {
+	var err error
+	l.dieOnce.Do(func() {
+		close(l.die)
+		err = l.ln.Close()
+	})
+	return err
+}
+
+// Addr returns the listening address
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
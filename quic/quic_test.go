@@ -0,0 +1,155 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func newListener(t *testing.T) *Listener {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}}}
+
+	ln, err := Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	return ln
+}
+
+func dial(t *testing.T, ln *Listener) *Session {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sess, err := Dial(ctx, ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	return sess
+}
+
+func TestStreamEcho(t *testing.T) {
+	ln := newListener(t)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	sess := dial(t, ln)
+	defer sess.Close()
+
+	for _, data := range [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("abcdefg"), 100000),
+	} {
+		conn, err := sess.Open()
+		if err != nil {
+			t.Fatalf("Open failed: %s", err)
+		}
+		go conn.Write(data)
+		b := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("Read got %d bytes different from the written ones", len(b))
+		}
+		conn.Close()
+	}
+}
+
+func TestDatagrams(t *testing.T) {
+	ln := newListener(t)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// the request and the reply are on the stream
+				b := make([]byte, 1)
+				if _, err := conn.Read(b); err != nil {
+					return
+				}
+				conn.Write(b)
+				dgrams := conn.(*Conn).Datagrams()
+				defer dgrams.Close()
+				for {
+					dgram, err := socks.ReadUDPDatagram(dgrams)
+					if err != nil {
+						return
+					}
+					if err := dgram.Write(dgrams); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	sess := dial(t, ln)
+	defer sess.Close()
+	conn, err := sess.Open()
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	conn.Write([]byte{0})
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Read reply failed: %s", err)
+	}
+	dgrams := conn.Datagrams()
+	defer dgrams.Close()
+
+	addr := socks.NewAddrFromPair("127.0.0.1", 53)
+	for _, data := range [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte{1}, 10000), // too large, it's sent on the stream
+	} {
+		dgram := socks.NewUDPDatagram(socks.NewUDPHeader(uint16(len(data)), 0, addr), data)
+		if err := dgram.Write(dgrams); err != nil {
+			t.Fatalf("Write datagram failed: %s", err)
+		}
+		dgrams.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, err := socks.ReadUDPDatagram(dgrams)
+		if err != nil {
+			t.Fatalf("Read datagram failed: %s", err)
+		}
+		if !bytes.Equal(reply.Data, data) || reply.Header.Addr.String() != addr.String() {
+			t.Fatalf("Read got %d bytes from %s", len(reply.Data), reply.Header.Addr)
+		}
+	}
+
+	// reads time out like UDP
+	dgrams.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := socks.ReadUDPDatagram(dgrams); err == nil {
+		t.Fatalf("Read should time out")
+	} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("Read error got %q, want timeout", err)
+	}
+}
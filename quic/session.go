@@ -0,0 +1,128 @@
+// Package quic carries tunnels as streams of QUIC connections. UDP datagrams
+// of a tunnel are sent as QUIC datagrams rather than on the stream.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// NextProto is the application protocol negotiated by TLS
+const NextProto = "subsocks"
+
+func quicConfig() *quicgo.Config {
+	return &quicgo.Config{
+		MaxIncomingStreams: 1024,
+		KeepAlivePeriod:    15 * time.Second,
+		EnableDatagrams:    true,
+	}
+}
+
+// tlsConfig returns a copy of config which negotiates NextProto
+func tlsConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.NextProtos = []string{NextProto}
+	return config
+}
+
+// Session is a QUIC connection, it dispatches datagrams to streams
+type Session struct {
+	conn quicgo.Connection
+
+	mu      sync.Mutex
+	streams map[quicgo.StreamID]*Conn
+}
+
+func newSession(conn quicgo.Connection) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[quicgo.StreamID]*Conn),
+	}
+	go s.receiveDatagrams()
+	return s
+}
+
+// Dial connects to the server at addr
+func Dial(ctx context.Context, addr string, config *tls.Config) (*Session, error) {
+	conn, err := quicgo.DialAddr(ctx, addr, tlsConfig(config), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return newSession(conn), nil
+}
+
+// Open opens a stream, it fails rather than blocks if the peer doesn't
+// allow more streams
+func (s *Session) Open() (*Conn, error) {
+	stream, err := s.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return s.addStream(stream), nil
+}
+
+// IsClosed returns whether the session is closed
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the session and all its streams
+func (s *Session) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+func (s *Session) addStream(stream quicgo.Stream) *Conn {
+	c := newConn(s, stream)
+	s.mu.Lock()
+	s.streams[stream.StreamID()] = c
+	s.mu.Unlock()
+	return c
+}
+
+func (s *Session) removeStream(id quicgo.StreamID) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// receiveDatagrams dispatches datagrams by the stream ID they start with
+func (s *Session) receiveDatagrams() {
+	for {
+		b, err := s.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		id, n := binary.Uvarint(b)
+		if n <= 0 {
+			continue
+		}
+
+		s.mu.Lock()
+		c := s.streams[quicgo.StreamID(id)]
+		s.mu.Unlock()
+		if c != nil {
+			c.pushDatagram(b[n:])
+		}
+	}
+}
+
+// sendDatagram sends b as a datagram of the stream
+func (s *Session) sendDatagram(id quicgo.StreamID, b []byte) error {
+	p := make([]byte, binary.MaxVarintLen64+len(b))
+	n := binary.PutUvarint(p, uint64(id))
+	n += copy(p[n:], b)
+	return s.conn.SendDatagram(p[:n])
+}
@@ -18,9 +18,12 @@ import (
 
 func launchServer(t *toml.Tree) {
 	config := struct {
-		Protocol string `toml:"protocol"`
-		Addr     string `toml:"listen"`
-		HTTP     struct {
+		Protocol   string `toml:"protocol"`
+		Addr       string `toml:"listen"`
+		Metrics    string `toml:"metrics"`
+		Admin      string `toml:"admin"`
+		AdminToken string `toml:"admin_token"`
+		HTTP       struct {
 			Path string `toml:"path" default:"/"`
 		} `toml:"http"`
 		WS struct {
@@ -28,9 +31,28 @@ func launchServer(t *toml.Tree) {
 			Compress bool   `toml:"compress"`
 		} `toml:"ws"`
 		TLS struct {
-			Cert string `toml:"cert"`
-			Key  string `toml:"key"`
+			Cert     string `toml:"cert"`
+			Key      string `toml:"key"`
+			Fallback string `toml:"fallback"`
 		} `toml:"tls"`
+		Mux struct {
+			Enable            bool `toml:"enable"`
+			KeepAliveInterval int  `toml:"keepalive_interval" default:"30"`
+			KeepAliveTimeout  int  `toml:"keepalive_timeout" default:"90"`
+		} `toml:"mux"`
+		Reverse struct {
+			Enable bool     `toml:"enable"`
+			Host   string   `toml:"host" default:"0.0.0.0"`
+			Ports  []string `toml:"ports"`
+		} `toml:"reverse"`
+		DNS struct {
+			Upstream string `toml:"upstream"`
+		} `toml:"dns"`
+		ACL struct {
+			Allow       []string `toml:"allow"`
+			Deny        []string `toml:"deny"`
+			DenyPrivate bool     `toml:"deny_private" default:"true"`
+		} `toml:"acl"`
 	}{}
 
 	if err := t.Unmarshal(&config); err != nil {
@@ -41,6 +63,33 @@ func launchServer(t *toml.Tree) {
 	ser.Config.HTTPPath = config.HTTP.Path
 	ser.Config.WSPath = config.WS.Path
 	ser.Config.WSCompress = config.WS.Compress
+	ser.Config.Mux = config.Mux.Enable
+	ser.Config.MuxKeepAliveInterval = time.Duration(config.Mux.KeepAliveInterval) * time.Second
+	ser.Config.MuxKeepAliveTimeout = time.Duration(config.Mux.KeepAliveTimeout) * time.Second
+	ser.Config.TLSFallback = config.TLS.Fallback
+	ser.Config.MetricsAddr = config.Metrics
+	ser.Config.AdminAddr = config.Admin
+	ser.Config.AdminToken = config.AdminToken
+	ser.Config.Reverse = config.Reverse.Enable
+	ser.Config.ReverseHost = config.Reverse.Host
+	ports, err := server.ParsePortRanges(config.Reverse.Ports)
+	if err != nil {
+		log.Fatalf("Parse 'server.reverse.ports' configuration failed: %s", err)
+	}
+	ser.Config.ReversePorts = ports
+
+	ser.Config.DNSUpstream = config.DNS.Upstream
+	if ser.Config.DNSUpstream == "" {
+		if ser.Config.DNSUpstream = utils.SystemDNS(); ser.Config.DNSUpstream == "" {
+			ser.Config.DNSUpstream = "8.8.8.8:53"
+		}
+	}
+
+	acl, err := server.NewACL(config.ACL.Allow, config.ACL.Deny, config.ACL.DenyPrivate)
+	if err != nil {
+		log.Fatalf("Parse 'server.acl' configuration failed: %s", err)
+	}
+	ser.ACL = acl
 
 	switch users := t.Get("users").(type) {
 	case string:
@@ -53,6 +102,10 @@ func launchServer(t *toml.Tree) {
 		ser.Config.Verify = utils.VerifyByMap(m)
 	}
 
+	if ser.Config.Reverse && ser.Config.Verify == nil {
+		log.Fatalf("Reverse tunnels require 'server.users', otherwise anyone can open listeners on the server")
+	}
+
 	if needsTLS[config.Protocol] {
 		tlsConfig, err := getServerTLSConfig(config.TLS.Cert, config.TLS.Key)
 		if err != nil {
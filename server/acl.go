@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/luyuhuang/subsocks/trie"
+)
+
+// ErrDenied means the destination is not allowed by the ACL
+var ErrDenied = errors.New("Destination is not allowed")
+
+// privateNets are addresses not routed on the internet, IPv4-mapped IPv6
+// addresses are matched as IPv4 ones
+var privateNets *addrList
+
+func init() {
+	privateNets, _ = newAddrList([]string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"64:ff9b::/96",
+		"64:ff9b:1::/48",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	})
+}
+
+// addrList matches addresses by IPs, CIDRs and domains in the syntax of
+// the client's rules, and a single '*' matches all.
+type addrList struct {
+	all  bool
+	tree *trie.Tree
+}
+
+func newAddrList(addrs []string) (*addrList, error) {
+	l := &addrList{tree: trie.New()}
+	for _, addr := range addrs {
+		if addr == "*" {
+			l.all = true
+		} else if strings.HasPrefix(addr, "*") && !strings.HasPrefix(addr, "*.") {
+			return nil, fmt.Errorf("Domain %q contains illegal wildcards", addr)
+		} else if err := l.tree.Set(strings.ToLower(addr), 1); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *addrList) matchIP(ip net.IP) bool {
+	return l.all || l.tree.MatchIP(ip) != 0
+}
+
+func (l *addrList) matchDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return l.all || l.tree.Domains.Match(domain) != 0
+}
+
+// ACL decides which destinations the server may connect to. Allowed
+// addresses are always allowed, otherwise denied addresses, and private and
+// loopback addresses if DenyPrivate is set, are refused.
+type ACL struct {
+	allow       *addrList
+	deny        *addrList
+	denyPrivate bool
+}
+
+// NewACL creates an ACL
+func NewACL(allow, deny []string, denyPrivate bool) (*ACL, error) {
+	a := &ACL{denyPrivate: denyPrivate}
+	var err error
+	if a.allow, err = newAddrList(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = newAddrList(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *ACL) allowIP(ip net.IP) bool {
+	if a.allow.matchIP(ip) {
+		return true
+	}
+	if a.deny.matchIP(ip) {
+		return false
+	}
+	return !a.denyPrivate || !privateNets.matchIP(ip)
+}
+
+// Resolve checks the address "host:port". If the host is a domain, it's
+// checked before and after being resolved, and the returned address
+// contains the allowed IP to dial, so that the domain cannot resolve into a
+// denied address later.
+func (a *ACL) Resolve(addr string) (string, error) {
+	if a == nil {
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !a.allowIP(ip) {
+			return "", ErrDenied
+		}
+		return addr, nil
+	}
+
+	if a.allow.matchDomain(host) {
+		return addr, nil
+	}
+	if a.deny.matchDomain(host) {
+		return "", ErrDenied
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if a.allowIP(ip.IP) {
+			return net.JoinHostPort(ip.IP.String(), port), nil
+		}
+	}
+	return "", ErrDenied
+}
+
+// AllowAddr checks an address that has been connected, such as the peer of
+// a Bind.
+func (a *ACL) AllowAddr(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && a.allowIP(ip)
+}
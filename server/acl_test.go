@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestACLResolve(t *testing.T) {
+	cases := []struct {
+		allow       []string
+		deny        []string
+		denyPrivate bool
+		addr        string
+		want        string
+		err         error
+	}{
+		{nil, nil, true, "8.8.8.8:53", "8.8.8.8:53", nil},
+		{nil, nil, true, "127.0.0.1:80", "", ErrDenied},
+		{nil, nil, true, "10.1.2.3:80", "", ErrDenied},
+		{nil, nil, true, "172.20.0.1:80", "", ErrDenied},
+		{nil, nil, true, "192.168.1.1:80", "", ErrDenied},
+		{nil, nil, true, "169.254.169.254:80", "", ErrDenied},
+		{nil, nil, true, "[::1]:80", "", ErrDenied},
+		{nil, nil, true, "[fd00::1]:80", "", ErrDenied},
+		{nil, nil, true, "[::ffff:127.0.0.1]:80", "", ErrDenied},
+		{nil, nil, true, "100.64.0.1:80", "", ErrDenied},
+		{nil, nil, true, "198.18.0.1:80", "", ErrDenied},
+		{nil, nil, true, "224.0.0.1:80", "", ErrDenied},
+		{nil, nil, true, "255.255.255.255:80", "", ErrDenied},
+		{nil, nil, true, "[64:ff9b::a00:1]:80", "", ErrDenied},
+		{nil, nil, false, "127.0.0.1:80", "127.0.0.1:80", nil},
+
+		// resolved domains are checked again
+		{nil, nil, true, "localhost:80", "", ErrDenied},
+		{[]string{"127.0.0.1"}, nil, true, "localhost:80", "127.0.0.1:80", nil},
+		{[]string{"localhost"}, nil, true, "localhost:80", "localhost:80", nil},
+		{nil, []string{"127.0.0.0/8", "::1"}, false, "localhost:80", "", ErrDenied},
+
+		{[]string{"10.1.0.0/16"}, nil, true, "10.1.2.3:80", "10.1.2.3:80", nil},
+		{[]string{"10.1.0.0/16"}, nil, true, "10.2.2.3:80", "", ErrDenied},
+		{nil, []string{"8.8.8.0/24"}, true, "8.8.8.8:53", "", ErrDenied},
+		{nil, []string{"*.example.com"}, true, "example.com:80", "", ErrDenied},
+		{nil, []string{"*.example.com"}, true, "www.Example.com:80", "", ErrDenied},
+		{nil, []string{"www.example.com"}, true, "www.example.com:80", "", ErrDenied},
+		{[]string{"a.example.com"}, []string{"*.example.com"}, true, "a.example.com:80", "a.example.com:80", nil},
+		{[]string{"8.8.8.8"}, []string{"*"}, true, "8.8.8.8:53", "8.8.8.8:53", nil},
+		{[]string{"8.8.8.8"}, []string{"*"}, true, "8.8.4.4:53", "", ErrDenied},
+	}
+
+	for _, c := range cases {
+		acl, err := NewACL(c.allow, c.deny, c.denyPrivate)
+		if err != nil {
+			t.Fatalf("Create ACL failed: %s", err)
+		}
+
+		addr, err := acl.Resolve(c.addr)
+		if err != c.err || addr != c.want {
+			t.Fatalf("Resolve %q with allow %v deny %v got %q, %v, want %q, %v",
+				c.addr, c.allow, c.deny, addr, err, c.want, c.err)
+		}
+	}
+}
+
+func TestACLIllegal(t *testing.T) {
+	for _, addr := range []string{"www.*.com", "www*.google.com", "**", "*google.com"} {
+		_, err := NewACL(nil, []string{addr}, true)
+		if err == nil || !strings.Contains(err.Error(), "contains illegal wildcards") {
+			t.Fatalf("Error %q does not contain 'contains illegal wildcards'", err)
+		}
+	}
+}
+
+func TestACLAllowAddr(t *testing.T) {
+	acl, _ := NewACL(nil, nil, true)
+
+	cases := []struct {
+		addr  string
+		allow bool
+	}{
+		{"127.0.0.1:1234", false},
+		{"8.8.8.8:1234", true},
+	}
+	for _, c := range cases {
+		addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+		if allow := acl.AllowAddr(addr); allow != c.allow {
+			t.Fatalf("AllowAddr %q got %v, want %v", c.addr, allow, c.allow)
+		}
+	}
+
+	var none *ACL
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:1234")
+	if !none.AllowAddr(addr) {
+		t.Fatalf("Nil ACL should allow all")
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/luyuhuang/subsocks/utils"
+	"golang.org/x/net/http2"
+)
+
+// h2IdleTimeout closes connections without streams for a while, the same
+// as clients do
+const h2IdleTimeout = 5 * time.Minute
+
+var h2Server = &http2.Server{IdleTimeout: h2IdleTimeout}
+
+// h2Handler serves an HTTP/2 connection, each stream of which is a tunnel
+func (s *Server) h2Handler(conn net.Conn) {
+	config := s.TLSConfig.Clone()
+	config.NextProtos = []string{"h2"}
+	tlsConn := tls.Server(conn, config)
+	// clients sending nothing mustn't hold the connection
+	conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("[h2] TLS handshake failed: %s", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		log.Printf("[h2] client %s doesn't speak HTTP/2, negotiated %q", conn.RemoteAddr(), proto)
+		conn.Close()
+		return
+	}
+
+	h2Server.ServeConn(tlsConn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.serveH2(w, req, conn)
+		}),
+	})
+}
+
+// serveH2 serves a stream, the request body carries data from the client
+// and the response body carries data back.
+func (s *Server) serveH2(w http.ResponseWriter, req *http.Request, conn net.Conn) {
+	var user string
+	if s.Config.Verify != nil {
+		var ok bool
+		user, ok = utils.HttpBasicAuthUser(req.Header.Get("Authorization"), s.Config.Verify)
+		if !ok {
+			authFailures.Inc("h2")
+			w.Header().Set("WWW-Authenticate", `Basic realm="auth"`)
+			h2Error(w, http.StatusUnauthorized)
+			return
+		}
+	}
+	if req.Method != http.MethodPost || !utils.StrEQ(req.URL.Path, s.Config.HTTPPath) {
+		h2Error(w, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+
+	// the response must not be written after the handler returns, so the
+	// handler writes what the tunnel writes to the pipe until it's closed
+	pr, pw := io.Pipe()
+	stream := utils.NewStreamConn(req.Body, pw, func() error {
+		pw.Close()
+		return req.Body.Close()
+	}, conn.LocalAddr(), conn.RemoteAddr())
+	go s.handleSocks(utils.WithUser(stream, user), nil)
+
+	b := utils.LPool.Get().([]byte)
+	defer utils.LPool.Put(b)
+	for {
+		n, err := pr.Read(b)
+		if n > 0 {
+			if _, err := w.Write(b[:n]); err != nil {
+				pr.CloseWithError(err)
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func h2Error(w http.ResponseWriter, code int) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "<h1>%d</h1><p>%s<p>", code, http.StatusText(code))
+}
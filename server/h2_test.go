@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/utils"
+	"golang.org/x/net/http2"
+)
+
+// testTLSConfig returns a server TLS configuration with the certificate of
+// httptest
+func testTLSConfig() *tls.Config {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	return &tls.Config{Certificates: ts.TLS.Certificates}
+}
+
+func TestH2Handler(t *testing.T) {
+	ser := NewServer("h2", "127.0.0.1:0")
+	ser.TLSConfig = testTLSConfig()
+	ser.Config.HTTPPath = "/proxy"
+	ser.Config.Verify = utils.VerifyByMap(map[string]string{"admin": "123456"})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ser.h2Handler(conn)
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		t.Fatalf("Create client connection failed: %s", err)
+	}
+
+	cases := []struct {
+		path     string
+		username string
+		password string
+		code     int
+	}{
+		{"/proxy", "admin", "123456", 200},
+		{"/proxy", "admin", "123456", 200},
+		{"/proxy", "admin", "abcdef", 401},
+		{"/proxy", "", "", 401},
+		{"/", "admin", "123456", 404},
+	}
+
+	// every stream is a tunnel of the same connection
+	var bodies []io.WriteCloser
+	for _, c := range cases {
+		pr, pw := io.Pipe()
+		bodies = append(bodies, pw)
+		req, _ := http.NewRequest(http.MethodPost, "https://"+ln.Addr().String()+c.path, pr)
+		if c.username != "" {
+			s := base64.StdEncoding.EncodeToString([]byte(c.username + ":" + c.password))
+			req.Header.Set("Authorization", "Basic "+s)
+		}
+		res, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Round trip failed: %s", err)
+		}
+		if res.StatusCode != c.code {
+			t.Fatalf("Status of %s by %s:%s got %d, want %d", c.path, c.username, c.password, res.StatusCode, c.code)
+		}
+		if c.code != 200 {
+			res.Body.Close()
+			continue
+		}
+
+		// the client is authorized already, so no socks5 authorization
+		if err := socks.WriteMethods([]uint8{socks.MethodNoAuth}, pw); err != nil {
+			t.Fatalf("Write methods failed: %s", err)
+		}
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(res.Body, b); err != nil {
+			t.Fatalf("Read method failed: %s", err)
+		}
+		if b[0] != socks.Version || b[1] != socks.MethodNoAuth {
+			t.Fatalf("Method got %v", b)
+		}
+	}
+	for _, body := range bodies {
+		body.Close()
+	}
+}
@@ -18,7 +18,7 @@ func (s *Server) httpsHandler(conn net.Conn) {
 }
 
 func (s *Server) httpHandler(conn net.Conn) {
-	s.socksHandler(newHTTPStripper(s, conn))
+	s.handleSocks(newHTTPStripper(s, conn), nil)
 }
 
 type httpStripper struct {
@@ -26,6 +26,7 @@ type httpStripper struct {
 	server     *Server
 	body       io.ReadCloser
 	sentHeader bool
+	user       string
 
 	ioBuf *bufio.Reader
 }
@@ -49,11 +50,14 @@ func (h *httpStripper) Read(b []byte) (n int, err error) {
 			return 0, err
 		}
 		if h.server.Config.Verify != nil {
-			if !utils.HttpBasicAuth(req.Header.Get("Authorization"), h.server.Config.Verify) {
+			user, ok := utils.HttpBasicAuthUser(req.Header.Get("Authorization"), h.server.Config.Verify)
+			if !ok {
 				req.Body.Close()
+				authFailures.Inc("http")
 				http4XXResponse(401).Write(h.Conn)
 				continue
 			}
+			h.user = user
 		}
 		if !utils.StrEQ(req.URL.Path, h.server.Config.HTTPPath) {
 			req.Body.Close()
@@ -71,6 +75,11 @@ func (h *httpStripper) Read(b []byte) (n int, err error) {
 	return h.body.Read(b)
 }
 
+// User returns the authorized user
+func (h *httpStripper) User() string {
+	return h.user
+}
+
 func (h *httpStripper) Write(b []byte) (n int, err error) {
 	if len(b) == 0 {
 		return 0, nil
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/luyuhuang/subsocks/metrics"
+	"github.com/luyuhuang/subsocks/tunnel"
+)
+
+var registry = metrics.NewRegistry()
+
+var (
+	tunnelsActive = registry.NewGauge("subsocks_server_tunnels_active",
+		"Number of active tunnels.", "command")
+	tunnelsTotal = registry.NewCounter("subsocks_server_tunnels_total",
+		"Number of established tunnels.", "command")
+	transferredBytes = registry.NewCounter("subsocks_server_transferred_bytes_total",
+		"Bytes transferred through tunnels, up is from the peer that opens the tunnel to the target.", "direction")
+	dialFailures = registry.NewCounter("subsocks_server_dial_failures_total",
+		"Number of failed dials to remote addresses.", "reason")
+	authFailures = registry.NewCounter("subsocks_server_auth_failures_total",
+		"Number of failed authorizations of clients.", "protocol")
+	handshakeSeconds = registry.NewHistogram("subsocks_server_handshake_seconds",
+		"Time from accepting a connection to finishing the socks5 handshake.", metrics.DefBuckets)
+)
+
+func (s *Server) serveMetrics(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	if err := http.Serve(listener, mux); err != nil {
+		log.Printf("Serve metrics failed: %s", err)
+	}
+}
+
+func countUp(t *tunnel.Tunnel, n int) {
+	transferredBytes.Add(float64(n), "up")
+	t.AddUp(n)
+}
+
+func countDown(t *tunnel.Tunnel, n int) {
+	transferredBytes.Add(float64(n), "down")
+	t.AddDown(n)
+}
+
+// dialFailureReason returns the reason label of errors from ACL and dialing
+func dialFailureReason(err error) string {
+	if err == ErrDenied {
+		return "denied"
+	}
+	return metrics.ErrReason(err)
+}
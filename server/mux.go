@@ -0,0 +1,54 @@
+package server
+
+import (
+	"log"
+	"net"
+
+	"github.com/luyuhuang/subsocks/mux"
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+func (s *Server) handleMux(conn net.Conn, req *socks.Request) {
+	if !s.Config.Mux {
+		log.Printf(`[socks5] "mux" multiplexing is disabled`)
+		if err := socks.NewReply(socks.CmdUnsupported, nil).Write(conn); err != nil {
+			log.Printf(`[socks5] "mux" write reply failed: %s`, err)
+		}
+		return
+	}
+
+	if err := socks.NewReply(socks.Succeeded, nil).Write(conn); err != nil {
+		log.Printf(`[socks5] "mux" write reply failed: %s`, err)
+		return
+	}
+
+	sess := mux.Server(conn, s.muxConfig())
+	defer sess.Close()
+
+	log.Printf(`[socks5] "mux" session established for %s`, conn.RemoteAddr())
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			break
+		}
+
+		go func() {
+			defer stream.Close()
+			s.handleRequest(utils.WithUser(stream, utils.UserOf(conn)))
+		}()
+	}
+	log.Printf(`[socks5] "mux" session disconnected for %s`, conn.RemoteAddr())
+}
+
+// muxConfig returns the configuration of mux sessions
+func (s *Server) muxConfig() *mux.Config {
+	config := mux.DefaultConfig()
+	if s.Config.MuxKeepAliveInterval > 0 {
+		config.KeepAliveInterval = s.Config.MuxKeepAliveInterval
+	}
+	if s.Config.MuxKeepAliveTimeout > 0 {
+		config.KeepAliveTimeout = s.Config.MuxKeepAliveTimeout
+	}
+	return config
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/mux"
+	"github.com/luyuhuang/subsocks/socks"
+)
+
+func TestMuxHalfClose(t *testing.T) {
+	// the remote answers only after reading the whole request
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("got "), b...))
+	}()
+
+	ser := NewServer("socks", "127.0.0.1:1080")
+	ser.Config.Mux = true
+
+	cli, conn := net.Pipe()
+	defer cli.Close()
+	go ser.handleRequest(conn)
+
+	if err := socks.NewRequest(socks.CmdMux, nil).Write(cli); err != nil {
+		t.Fatalf("Write request failed: %s", err)
+	}
+	rep, err := socks.ReadReply(cli)
+	if err != nil {
+		t.Fatalf("Read reply failed: %s", err)
+	}
+	if rep.Rep != socks.Succeeded {
+		t.Fatalf("Reply got %d, want %d", rep.Rep, socks.Succeeded)
+	}
+
+	sess := mux.Client(cli, nil)
+	defer sess.Close()
+	stream, err := sess.Open()
+	if err != nil {
+		t.Fatalf("Open stream failed: %s", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+
+	addr := ln.Addr().(*net.TCPAddr)
+	if err := socks.NewRequest(socks.CmdConnect, socks.NewAddrFromPair(addr.IP.String(), addr.Port)).Write(stream); err != nil {
+		t.Fatalf("Write request failed: %s", err)
+	}
+	if rep, err := socks.ReadReply(stream); err != nil || rep.Rep != socks.Succeeded {
+		t.Fatalf("Read reply got %v, %v, want %d", rep, err, socks.Succeeded)
+	}
+
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatalf("Close write failed: %s", err)
+	}
+	b, err := io.ReadAll(stream)
+	if err != nil || string(b) != "got ping" {
+		t.Fatalf("Read got %q, %v, want %q", b, err, "got ping")
+	}
+}
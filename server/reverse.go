@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/luyuhuang/subsocks/mux"
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+// handleReverse listens on the port the client requests, and relays every
+// accepted connection back to the client in a stream of the session
+func (s *Server) handleReverse(conn net.Conn, req *socks.Request) {
+	if !s.Config.Reverse {
+		log.Printf(`[socks5] "reverse" reverse tunnel is disabled`)
+		if err := socks.NewReply(socks.CmdUnsupported, nil).Write(conn); err != nil {
+			log.Printf(`[socks5] "reverse" write reply failed: %s`, err)
+		}
+		return
+	}
+
+	var port uint16
+	if req.Addr != nil {
+		port = req.Addr.Port
+	}
+	if s.Config.Verify == nil || !s.reversePortAllowed(port) {
+		// anonymous clients mustn't open public listeners
+		log.Printf(`[socks5] "reverse" port %d for %s is not allowed`, port, conn.RemoteAddr())
+		if err := socks.NewReply(socks.Allowed, nil).Write(conn); err != nil {
+			log.Printf(`[socks5] "reverse" write reply failed: %s`, err)
+		}
+		return
+	}
+	laddr := net.JoinHostPort(s.Config.ReverseHost, strconv.Itoa(int(port)))
+	listener, err := net.Listen("tcp", laddr)
+	if err != nil {
+		log.Printf(`[socks5] "reverse" listen %s failed: %s`, laddr, err)
+		if err := socks.NewReply(socks.Failure, nil).Write(conn); err != nil {
+			log.Printf(`[socks5] "reverse" write reply failed: %s`, err)
+		}
+		return
+	}
+	defer listener.Close()
+
+	addr, _ := socks.NewAddrFromAddr(listener.Addr(), listener.Addr())
+	if err := socks.NewReply(socks.Succeeded, addr).Write(conn); err != nil {
+		log.Printf(`[socks5] "reverse" write reply failed: %s`, err)
+		return
+	}
+
+	sess := mux.Client(conn, s.muxConfig())
+	defer sess.Close()
+	go func() {
+		<-sess.Done()
+		listener.Close()
+	}()
+
+	log.Printf(`[socks5] "reverse" tunnel established %s <-> %s`, listener.Addr(), conn.RemoteAddr())
+	for {
+		newConn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+
+		go func() {
+			defer newConn.Close()
+			stream, err := sess.Open()
+			if err != nil {
+				log.Printf(`[socks5] "reverse" open stream failed: %s`, err)
+				return
+			}
+			defer stream.Close()
+
+			log.Printf(`[socks5] "reverse" relay %s to %s`, newConn.RemoteAddr(), conn.RemoteAddr())
+			t := &tunnel.Tunnel{
+				Command:     "reverse",
+				User:        utils.UserOf(conn),
+				Source:      newConn.RemoteAddr().String(),
+				Destination: conn.RemoteAddr().String(),
+			}
+			if err := s.transport(t, newConn, stream); err != nil {
+				log.Printf(`[socks5] "reverse" transport failed: %s`, err)
+			}
+		}()
+	}
+	log.Printf(`[socks5] "reverse" tunnel disconnected %s >-< %s`, listener.Addr(), conn.RemoteAddr())
+}
+
+// PortRange is a range of ports from Lo to Hi
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+// ParsePortRanges parses ports such as "8000" and "8000-8100"
+func ParsePortRanges(ports []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+		lo, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Ports %q are illegal", p)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16); err != nil {
+				return nil, fmt.Errorf("Ports %q are illegal", p)
+			}
+		}
+		if lo == 0 || lo > hi {
+			return nil, fmt.Errorf("Ports %q are illegal", p)
+		}
+		ranges = append(ranges, PortRange{uint16(lo), uint16(hi)})
+	}
+	return ranges, nil
+}
+
+// reversePortAllowed returns whether clients can listen on the port. If no
+// ports are configured, unprivileged and random ports are allowed.
+func (s *Server) reversePortAllowed(port uint16) bool {
+	if len(s.Config.ReversePorts) == 0 {
+		return port == 0 || port >= 1024
+	}
+	for _, r := range s.Config.ReversePorts {
+		if r.Lo <= port && port <= r.Hi {
+			return true
+		}
+	}
+	return false
+}
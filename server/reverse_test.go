@@ -0,0 +1,139 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/mux"
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+func TestReverse(t *testing.T) {
+	ser := NewServer("socks", "127.0.0.1:1080")
+	ser.Config.Reverse = true
+	ser.Config.ReverseHost = "127.0.0.1"
+	ser.Config.Verify = utils.VerifyByMap(map[string]string{"admin": "123456"})
+
+	cli, conn := net.Pipe()
+	defer cli.Close()
+	go ser.handleRequest(conn)
+
+	if err := socks.NewRequest(socks.CmdReverse, socks.NewAddrFromPair("0.0.0.0", 0)).Write(cli); err != nil {
+		t.Fatalf("Write request failed: %s", err)
+	}
+	rep, err := socks.ReadReply(cli)
+	if err != nil {
+		t.Fatalf("Read reply failed: %s", err)
+	}
+	if rep.Rep != socks.Succeeded {
+		t.Fatalf("Reply got %d, want %d", rep.Rep, socks.Succeeded)
+	}
+
+	sess := mux.Server(cli, nil)
+	defer sess.Close()
+
+	peer, err := net.Dial("tcp", rep.Addr.String())
+	if err != nil {
+		t.Fatalf("Dial reverse listener failed: %s", err)
+	}
+	defer peer.Close()
+
+	stream, err := sess.Accept()
+	if err != nil {
+		t.Fatalf("Accept stream failed: %s", err)
+	}
+	defer stream.Close()
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(stream, b); err != nil || string(b) != "ping" {
+		t.Fatalf("Stream read got %q, %v, want %q", b, err, "ping")
+	}
+
+	if _, err := stream.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if _, err := io.ReadFull(peer, b); err != nil || string(b) != "pong" {
+		t.Fatalf("Peer read got %q, %v, want %q", b, err, "pong")
+	}
+}
+
+func TestReverseDisabled(t *testing.T) {
+	ser := NewServer("socks", "127.0.0.1:1080")
+
+	cli, conn := net.Pipe()
+	defer cli.Close()
+	go ser.handleRequest(conn)
+
+	if err := socks.NewRequest(socks.CmdReverse, socks.NewAddrFromPair("0.0.0.0", 0)).Write(cli); err != nil {
+		t.Fatalf("Write request failed: %s", err)
+	}
+	rep, err := socks.ReadReply(cli)
+	if err != nil {
+		t.Fatalf("Read reply failed: %s", err)
+	}
+	if rep.Rep != socks.CmdUnsupported {
+		t.Fatalf("Reply got %d, want %d", rep.Rep, socks.CmdUnsupported)
+	}
+}
+
+func TestReverseNotAllowed(t *testing.T) {
+	verify := utils.VerifyByMap(map[string]string{"admin": "123456"})
+	cases := []struct {
+		verify func(string, string) bool
+		ports  []string
+		port   int
+	}{
+		{nil, nil, 0},     // anonymous clients
+		{verify, nil, 80}, // privileged ports
+		{verify, []string{"9000-9100", "9200"}, 9101},
+		{verify, []string{"9000-9100", "9200"}, 0},
+	}
+
+	for _, c := range cases {
+		ser := NewServer("socks", "127.0.0.1:1080")
+		ser.Config.Reverse = true
+		ser.Config.ReverseHost = "127.0.0.1"
+		ser.Config.Verify = c.verify
+		ports, err := ParsePortRanges(c.ports)
+		if err != nil {
+			t.Fatalf("Parse ports failed: %s", err)
+		}
+		ser.Config.ReversePorts = ports
+
+		cli, conn := net.Pipe()
+		go ser.handleRequest(conn)
+
+		if err := socks.NewRequest(socks.CmdReverse, socks.NewAddrFromPair("0.0.0.0", c.port)).Write(cli); err != nil {
+			t.Fatalf("Write request failed: %s", err)
+		}
+		rep, err := socks.ReadReply(cli)
+		if err != nil {
+			t.Fatalf("Read reply failed: %s", err)
+		}
+		if rep.Rep != socks.Allowed {
+			t.Fatalf("Reply of port %d with ports %v got %d, want %d", c.port, c.ports, rep.Rep, socks.Allowed)
+		}
+		cli.Close()
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges([]string{"8000", "9000-9100"})
+	if err != nil {
+		t.Fatalf("Parse ports failed: %s", err)
+	}
+	if len(ranges) != 2 || ranges[0] != (PortRange{8000, 8000}) || ranges[1] != (PortRange{9000, 9100}) {
+		t.Fatalf("Ports got %v", ranges)
+	}
+
+	for _, ports := range []string{"0", "a", "9100-9000", "1-70000"} {
+		if _, err := ParsePortRanges([]string{ports}); err == nil {
+			t.Fatalf("Ports %q should be illegal", ports)
+		}
+	}
+}
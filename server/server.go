@@ -5,12 +5,19 @@ import (
 	"errors"
 	"log"
 	"net"
+	"time"
+
+	"github.com/luyuhuang/subsocks/quic"
+	"github.com/luyuhuang/subsocks/tunnel"
 )
 
 // Server holds contexts of the server
 type Server struct {
 	Config    *Config
 	TLSConfig *tls.Config
+	ACL       *ACL
+
+	tunnels *tunnel.Registry
 }
 
 // NewServer creates a server
@@ -20,6 +27,7 @@ func NewServer(protocol, addr string) *Server {
 			Protocol: protocol,
 			Addr:     addr,
 		},
+		tunnels: tunnel.NewRegistry(),
 	}
 }
 
@@ -29,6 +37,9 @@ var protocol2handler = map[string]func(*Server, net.Conn){
 	"socks": (*Server).socksHandler,
 	"ws":    (*Server).wsHandler,
 	"wss":   (*Server).wssHandler,
+	"h2":    (*Server).h2Handler,
+	"quic":  (*Server).socksHandler,
+	"tls":   (*Server).tlsHandler,
 }
 
 // Serve start the server
@@ -38,19 +49,55 @@ func (s *Server) Serve() error {
 		return errors.New("Unknow protocol")
 	}
 
-	laddr, err := net.ResolveTCPAddr("tcp", s.Config.Addr)
-	if err != nil {
-		return err
-	}
-	listener, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		return err
+	var listener net.Listener
+	if s.Config.Protocol == "quic" {
+		// every stream is accepted as a connection
+		l, err := quic.Listen(s.Config.Addr, s.TLSConfig)
+		if err != nil {
+			return err
+		}
+		listener = l
+	} else {
+		laddr, err := net.ResolveTCPAddr("tcp", s.Config.Addr)
+		if err != nil {
+			return err
+		}
+		if listener, err = net.ListenTCP("tcp", laddr); err != nil {
+			return err
+		}
 	}
 	log.Printf("Server starts to listen %s://%s", s.Config.Protocol, listener.Addr().String())
 
+	if s.Config.MetricsAddr != "" {
+		ml, err := net.Listen("tcp", s.Config.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Server starts to serve metrics at http://%s/metrics", ml.Addr().String())
+		go s.serveMetrics(ml)
+	}
+
+	if s.Config.AdminAddr != "" {
+		al, err := tunnel.ListenAdmin(s.Config.AdminAddr, s.Config.AdminToken)
+		if err != nil {
+			return err
+		}
+		log.Printf("Server starts to serve admin API at http://%s", al.Addr().String())
+		go s.serveAdmin(al)
+	}
+
+	return s.serve(listener, handler)
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve(listener net.Listener, handler func(*Server, net.Conn)) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			// the QUIC listener is closed once its socket fails
+			if err == quic.ErrListenerClosed || errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			continue
 		}
 
@@ -66,4 +113,20 @@ type Config struct {
 	HTTPPath   string
 	WSPath     string
 	WSCompress bool
+
+	Mux                  bool
+	MuxKeepAliveInterval time.Duration // zero means the default
+	MuxKeepAliveTimeout  time.Duration // zero means the default
+
+	MetricsAddr string
+	AdminAddr   string
+	AdminToken  string
+
+	Reverse      bool
+	ReverseHost  string
+	ReversePorts []PortRange
+
+	DNSUpstream string
+
+	TLSFallback string
 }
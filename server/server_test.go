@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/luyuhuang/subsocks/quic"
+)
+
+func TestServeListenerClosed(t *testing.T) {
+	ser := NewServer("quic", "127.0.0.1:0")
+	ln, err := quic.Listen(ser.Config.Addr, testTLSConfig())
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ser.serve(ln, func(*Server, net.Conn) {})
+	}()
+	ln.Close()
+
+	select {
+	case err := <-done:
+		if err != quic.ErrListenerClosed {
+			t.Fatalf("Serve got %v, want %v", err, quic.ErrListenerClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve doesn't return after the listener is closed")
+	}
+}
@@ -1,15 +1,26 @@
 package server
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/tunnel"
 	"github.com/luyuhuang/subsocks/utils"
 )
 
 func (s *Server) socksHandler(conn net.Conn) {
+	s.handleSocks(conn, s.Config.Verify)
+}
+
+// handleSocks serves a socks5 connection, the client must authorize by
+// username and password if verify is not nil. Transports that have
+// authorized the client already pass a nil verify.
+func (s *Server) handleSocks(conn net.Conn, verify func(string, string) bool) {
 	defer conn.Close()
+	start := time.Now()
 
 	// select method
 	methods, err := socks.ReadMethods(conn)
@@ -19,7 +30,8 @@ func (s *Server) socksHandler(conn net.Conn) {
 	}
 	method := socks.MethodNoAcceptable
 	for _, m := range methods {
-		if m == socks.MethodNoAuth {
+		if m == socks.MethodNoAuth && verify == nil ||
+			m == socks.MethodUserPass && verify != nil {
 			method = m
 		}
 	}
@@ -32,6 +44,37 @@ func (s *Server) socksHandler(conn net.Conn) {
 		return
 	}
 
+	if method == socks.MethodUserPass {
+		user, err := authUserPass(conn, verify)
+		if err != nil {
+			authFailures.Inc("socks")
+			log.Printf(`[socks5] authorization failed: %s`, err)
+			return
+		}
+		conn = utils.WithUser(conn, user)
+	}
+	handshakeSeconds.Observe(time.Since(start).Seconds())
+
+	s.handleRequest(conn)
+}
+
+func authUserPass(conn net.Conn, verify func(string, string) bool) (string, error) {
+	req, err := socks.ReadUserPassRequest(conn)
+	if err != nil {
+		return "", err
+	}
+
+	if !verify(req.Username, req.Password) {
+		if e := socks.NewUserPassResponse(socks.UserPassVer, 1).Write(conn); e != nil {
+			log.Printf(`[socks5] write reply failed: %s`, e)
+		}
+		return "", fmt.Errorf(`verify user %s failed`, req.Username)
+	}
+
+	return req.Username, socks.NewUserPassResponse(socks.UserPassVer, 0).Write(conn)
+}
+
+func (s *Server) handleRequest(conn net.Conn) {
 	// read command
 	request, err := socks.ReadRequest(conn)
 	if err != nil {
@@ -52,13 +95,32 @@ func (s *Server) socksHandler(conn net.Conn) {
 		return
 	case socks.CmdUDPOverTCP:
 		s.handleUDPOverTCP(conn, request)
+	case socks.CmdMux:
+		s.handleMux(conn, request)
+	case socks.CmdReverse:
+		s.handleReverse(conn, request)
 	}
 }
 
 func (s *Server) handleConnect(conn net.Conn, req *socks.Request) {
 	log.Printf(`[socks5] "connect" connect %s for %s`, req.Addr, conn.RemoteAddr())
-	newConn, err := net.Dial("tcp", req.Addr.String())
+	addr, err := s.ACL.Resolve(req.Addr.String())
+	if err != nil {
+		dialFailures.Inc(dialFailureReason(err))
+		log.Printf(`[socks5] "connect" check %s failed: %s`, req.Addr, err)
+		rep := socks.HostUnreachable
+		if err == ErrDenied {
+			rep = socks.Allowed
+		}
+		if err := socks.NewReply(rep, nil).Write(conn); err != nil {
+			log.Printf(`[socks5] "connect" write reply failed: %s`, err)
+		}
+		return
+	}
+
+	newConn, err := net.Dial("tcp", addr)
 	if err != nil {
+		dialFailures.Inc(dialFailureReason(err))
 		log.Printf(`[socks5] "connect" dial remote failed: %s`, err)
 		if err := socks.NewReply(socks.HostUnreachable, nil).Write(conn); err != nil {
 			log.Printf(`[socks5] "connect" write reply failed: %s`, err)
@@ -73,7 +135,13 @@ func (s *Server) handleConnect(conn net.Conn, req *socks.Request) {
 	}
 
 	log.Printf(`[socks5] "connect" tunnel established %s <-> %s`, conn.RemoteAddr(), req.Addr)
-	if err := utils.Transport(conn, newConn); err != nil {
+	t := &tunnel.Tunnel{
+		Command:     "connect",
+		User:        utils.UserOf(conn),
+		Source:      conn.RemoteAddr().String(),
+		Destination: req.Addr.String(),
+	}
+	if err := s.transport(t, conn, newConn); err != nil {
 		log.Printf(`[socks5] "connect" transport failed: %s`, err)
 	}
 	log.Printf(`[socks5] "connect" tunnel disconnected %s >-< %s`, conn.RemoteAddr(), req.Addr)
@@ -109,6 +177,14 @@ func (s *Server) handleBind(conn net.Conn, req *socks.Request) {
 	}
 	defer newConn.Close()
 
+	if !s.ACL.AllowAddr(newConn.RemoteAddr()) {
+		log.Printf(`[socks5] "bind" peer %s is not allowed`, newConn.RemoteAddr())
+		if err := socks.NewReply(socks.Allowed, nil).Write(conn); err != nil {
+			log.Printf(`[socks5] "bind" write reply failed %s`, err)
+		}
+		return
+	}
+
 	// second response: accepted address
 	raddr, _ := socks.NewAddr(newConn.RemoteAddr().String())
 	if err := socks.NewReply(socks.Succeeded, raddr).Write(conn); err != nil {
@@ -117,7 +193,13 @@ func (s *Server) handleBind(conn net.Conn, req *socks.Request) {
 	}
 
 	log.Printf(`[socks5] "bind" tunnel established %s <-> %s`, conn.RemoteAddr(), newConn.RemoteAddr())
-	if err := utils.Transport(conn, newConn); err != nil {
+	t := &tunnel.Tunnel{
+		Command:     "bind",
+		User:        utils.UserOf(conn),
+		Source:      conn.RemoteAddr().String(),
+		Destination: newConn.RemoteAddr().String(),
+	}
+	if err := s.transport(t, conn, newConn); err != nil {
 		log.Printf(`[socks5] "bind" transport failed: %s`, err)
 	}
 	log.Printf(`[socks5] "bind" tunnel disconnected %s >-< %s`, conn.RemoteAddr(), newConn.RemoteAddr())
@@ -141,14 +223,28 @@ func (s *Server) handleUDPOverTCP(conn net.Conn, req *socks.Request) {
 		return
 	}
 
+	// QUIC streams send datagrams apart
+	dgrams := conn
+	if d := utils.DatagramsOf(conn); d != nil {
+		dgrams = d
+	}
+
 	log.Printf(`[socks5] "udp-over-tcp" tunnel established %s <-> (UDP)%s`, conn.RemoteAddr(), udp.LocalAddr())
-	if err := tunnelUDP(conn, udp); err != nil {
+	t := &tunnel.Tunnel{
+		Command:     "udp",
+		User:        utils.UserOf(conn),
+		Source:      conn.RemoteAddr().String(),
+		Destination: "(UDP)" + udp.LocalAddr().String(),
+	}
+	s.openTunnel(t, conn, udp)
+	defer s.closeTunnel(t)
+	if err := s.tunnelUDP(dgrams, udp, t); err != nil {
 		log.Printf(`[socks5] "udp-over-tcp" tunnel UDP failed: %s`, err)
 	}
 	log.Printf(`[socks5] "udp-over-tcp" tunnel disconnected %s >-< (UDP)%s`, conn.RemoteAddr(), udp.LocalAddr())
 }
 
-func tunnelUDP(conn net.Conn, udp net.PacketConn) error {
+func (s *Server) tunnelUDP(conn net.Conn, udp net.PacketConn, t *tunnel.Tunnel) error {
 	errc := make(chan error, 2)
 
 	go func() {
@@ -169,6 +265,7 @@ func tunnelUDP(conn net.Conn, udp net.PacketConn) error {
 				errc <- err
 				return
 			}
+			countDown(t, n)
 		}
 	}()
 
@@ -180,7 +277,12 @@ func tunnelUDP(conn net.Conn, udp net.PacketConn) error {
 				return
 			}
 
-			addr, err := net.ResolveUDPAddr("udp", dgram.Header.Addr.String())
+			raddr, err := s.resolveUDP(dgram.Header.Addr)
+			if err != nil {
+				log.Printf(`[socks5] "udp-over-tcp" check %s failed: %s`, dgram.Header.Addr, err)
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", raddr)
 			if err != nil {
 				continue
 			}
@@ -188,8 +290,20 @@ func tunnelUDP(conn net.Conn, udp net.PacketConn) error {
 				errc <- err
 				return
 			}
+			countUp(t, len(dgram.Data))
 		}
 	}()
 
 	return <-errc
 }
+
+// resolveUDP checks the destination of a datagram by the ACL. Datagrams to
+// port 53 of the unspecified address are sent to the DNS upstream.
+func (s *Server) resolveUDP(addr *socks.Addr) (string, error) {
+	if s.Config.DNSUpstream != "" && addr.Port == 53 {
+		if ip := net.ParseIP(addr.Host); ip != nil && ip.IsUnspecified() {
+			return s.Config.DNSUpstream, nil
+		}
+	}
+	return s.ACL.Resolve(addr.String())
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+func TestSocksUserPass(t *testing.T) {
+	cases := []struct {
+		users    map[string]string
+		methods  []uint8
+		method   uint8
+		username string
+		password string
+		status   uint8
+	}{
+		{nil, []uint8{socks.MethodNoAuth}, socks.MethodNoAuth, "", "", 0},
+		{nil, []uint8{socks.MethodNoAuth, socks.MethodUserPass}, socks.MethodNoAuth, "", "", 0},
+		{map[string]string{"admin": "123456"}, []uint8{socks.MethodNoAuth}, socks.MethodNoAcceptable, "", "", 0},
+		{map[string]string{"admin": "123456"}, []uint8{socks.MethodNoAuth, socks.MethodUserPass}, socks.MethodUserPass, "admin", "123456", 0},
+		{map[string]string{"admin": "123456"}, []uint8{socks.MethodUserPass}, socks.MethodUserPass, "admin", "abcdef", 1},
+		{map[string]string{"admin": "123456"}, []uint8{socks.MethodUserPass}, socks.MethodUserPass, "guest", "123456", 1},
+	}
+
+	for _, c := range cases {
+		ser := NewServer("socks", "127.0.0.1:1080")
+		if c.users != nil {
+			ser.Config.Verify = utils.VerifyByMap(c.users)
+		}
+
+		cli, conn := net.Pipe()
+		go ser.socksHandler(conn)
+
+		if err := socks.WriteMethods(c.methods, cli); err != nil {
+			t.Fatalf("Write methods failed: %s", err)
+		}
+		b := make([]byte, 2)
+		if _, err := cli.Read(b); err != nil {
+			t.Fatalf("Read method failed: %s", err)
+		}
+		if b[1] != c.method {
+			t.Fatalf("Method got %d, want %d", b[1], c.method)
+		}
+
+		if c.method == socks.MethodUserPass {
+			req := socks.NewUserPassRequest(socks.UserPassVer, c.username, c.password)
+			if err := req.Write(cli); err != nil {
+				t.Fatalf("Write user pass request failed: %s", err)
+			}
+			res, err := socks.ReadUserPassResponse(cli)
+			if err != nil {
+				t.Fatalf("Read user pass response failed: %s", err)
+			}
+			if res.Status != c.status {
+				t.Fatalf("User %s:%s status got %d, want %d", c.username, c.password, res.Status, c.status)
+			}
+		}
+
+		if c.method != socks.MethodNoAcceptable && c.status == 0 {
+			// the server handles requests after authorization
+			if err := socks.NewRequest(socks.CmdUDP, nil).Write(cli); err != nil {
+				t.Fatalf("Write request failed: %s", err)
+			}
+			rep, err := socks.ReadReply(cli)
+			if err != nil {
+				t.Fatalf("Read reply failed: %s", err)
+			}
+			if rep.Rep != socks.CmdUnsupported {
+				t.Fatalf("Reply got %d, want %d", rep.Rep, socks.CmdUnsupported)
+			}
+		}
+		cli.Close()
+	}
+}
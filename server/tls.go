@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/luyuhuang/subsocks/socks"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+// tlsHandshakeTimeout is how long a client has to finish the TLS handshake
+// and send the first bytes
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsHandler serves socks5 directly over TLS. Connections not starting with
+// a socks5 handshake are relayed to the fallback.
+func (s *Server) tlsHandler(conn net.Conn) {
+	// clients sending nothing mustn't hold the connection
+	conn.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+	tlsConn := tls.Server(conn, s.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("[tls] handshake with %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	br := bufio.NewReader(tlsConn)
+	b, err := br.Peek(2)
+	if err != nil {
+		log.Printf("[tls] read from %s failed: %s", conn.RemoteAddr(), err)
+		tlsConn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	bc := &bufferedConn{tlsConn, br}
+	if b[0] == socks.Version && b[1] > 0 {
+		s.handleSocks(bc, s.Config.Verify)
+	} else {
+		s.fallback(bc)
+	}
+}
+
+// fallback relays the decrypted connection to the fallback backend, or
+// closes it if there's none
+func (s *Server) fallback(conn net.Conn) {
+	defer conn.Close()
+	if s.Config.TLSFallback == "" {
+		log.Printf("[tls] %s doesn't speak socks5, close it", conn.RemoteAddr())
+		return
+	}
+
+	backend, err := net.Dial("tcp", s.Config.TLSFallback)
+	if err != nil {
+		log.Printf("[tls] dial fallback %s failed: %s", s.Config.TLSFallback, err)
+		return
+	}
+	defer backend.Close()
+
+	log.Printf("[tls] fall back %s to %s", conn.RemoteAddr(), s.Config.TLSFallback)
+	if err := utils.Transport(conn, backend); err != nil {
+		log.Printf("[tls] fallback transport failed: %s", err)
+	}
+}
+
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
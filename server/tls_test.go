@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestTLSFallback(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte("backend: " + line))
+			conn.Close()
+		}
+	}()
+
+	cases := []struct {
+		fallback string
+		data     string
+		res      string
+	}{
+		{backend.Addr().String(), "GET / HTTP/1.1\r\n", "backend: GET / HTTP/1.1\r\n"},
+		// a socks5 version without methods isn't socks5
+		{backend.Addr().String(), "\x05\x00\n", "backend: \x05\x00\n"},
+		{"", "GET / HTTP/1.1\r\n", ""},
+		{backend.Addr().String(), "\x05\x01\x00", "\x05\x00"},
+	}
+
+	for _, c := range cases {
+		ser := NewServer("tls", "127.0.0.1:0")
+		ser.TLSConfig = testTLSConfig()
+		ser.Config.TLSFallback = c.fallback
+
+		cli, conn := net.Pipe()
+		go ser.tlsHandler(conn)
+
+		tlsConn := tls.Client(cli, &tls.Config{InsecureSkipVerify: true})
+		if _, err := tlsConn.Write([]byte(c.data)); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		var res []byte
+		if c.res == "" {
+			// closed without fallback
+			res, err = ioutil.ReadAll(tlsConn)
+		} else {
+			res = make([]byte, len(c.res))
+			_, err = io.ReadFull(tlsConn, res)
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if string(res) != c.res {
+			t.Fatalf("Response of %q with fallback %q got %q, want %q", c.data, c.fallback, res, c.res)
+		}
+		tlsConn.Close()
+	}
+}
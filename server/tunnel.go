@@ -0,0 +1,44 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/luyuhuang/subsocks/tunnel"
+	"github.com/luyuhuang/subsocks/utils"
+)
+
+// openTunnel records the tunnel, closers are closed if it's closed by the
+// admin API
+func (s *Server) openTunnel(t *tunnel.Tunnel, closers ...io.Closer) {
+	tunnelsTotal.Inc(t.Command)
+	tunnelsActive.Inc(t.Command)
+	s.tunnels.Add(t, closers...)
+}
+
+func (s *Server) closeTunnel(t *tunnel.Tunnel) {
+	tunnelsActive.Dec(t.Command)
+	s.tunnels.Remove(t)
+}
+
+// transport transports conn1 and conn2 as the tunnel t, conn1 is the peer
+// that opens the tunnel
+func (s *Server) transport(t *tunnel.Tunnel, conn1, conn2 net.Conn) error {
+	s.openTunnel(t, conn1, conn2)
+	defer s.closeTunnel(t)
+
+	return utils.TransportCount(conn1, conn2,
+		func(n int) { countUp(t, n) },
+		func(n int) { countDown(t, n) })
+}
+
+func (s *Server) serveAdmin(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/tunnels", http.StripPrefix("/tunnels", s.tunnels))
+	mux.Handle("/tunnels/", http.StripPrefix("/tunnels", s.tunnels))
+	if err := http.Serve(listener, tunnel.RequireToken(s.Config.AdminToken, mux)); err != nil {
+		log.Printf("Serve admin API failed: %s", err)
+	}
+}
@@ -18,7 +18,7 @@ func (s *Server) wssHandler(conn net.Conn) {
 }
 
 func (s *Server) wsHandler(conn net.Conn) {
-	s.socksHandler(newWSStripper(s, conn))
+	s.handleSocks(newWSStripper(s, conn), nil)
 }
 
 type wsStripper struct {
@@ -26,6 +26,7 @@ type wsStripper struct {
 	server *Server
 	buf    *bytes.Buffer
 	ioBuf  *bufio.Reader
+	user   string
 
 	wsConn   *websocket.Conn
 	upgrader *websocket.Upgrader
@@ -71,6 +72,11 @@ func (w *wsStripper) Read(b []byte) (n int, err error) {
 	return
 }
 
+// User returns the authorized user
+func (w *wsStripper) User() string {
+	return w.user
+}
+
 func (w *wsStripper) Write(b []byte) (n int, err error) {
 	if w.wsConn == nil {
 		w.wsConn, err = w.handshake()
@@ -99,11 +105,14 @@ func (w *wsStripper) handshake() (conn *websocket.Conn, err error) {
 		}
 
 		if w.server.Config.Verify != nil {
-			if !utils.HttpBasicAuth(req.Header.Get("Authorization"), w.server.Config.Verify) {
+			user, ok := utils.HttpBasicAuthUser(req.Header.Get("Authorization"), w.server.Config.Verify)
+			if !ok {
 				req.Body.Close()
+				authFailures.Inc("ws")
 				http4XXResponse(401).Write(w.Conn)
 				continue
 			}
+			w.user = user
 		}
 		if !utils.StrEQ(req.URL.Path, w.server.Config.WSPath) ||
 			req.Header.Get("Connection") != "Upgrade" ||
@@ -0,0 +1,191 @@
+package socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Version4 is the version of SOCKS4 and SOCKS4a
+const Version4 = 4
+
+// SOCKS4 reply codes
+const (
+	Granted4  uint8 = 0x5A
+	Rejected4 uint8 = 0x5B
+)
+
+/*
+Request4 is a SOCKS4 or SOCKS4a request. In SOCKS4a, DSTIP is 0.0.0.x
+(x != 0) and the NULL-terminated domain follows USERID.
+
+	+----+----+---------+-------+----------+------+
+	| VN | CD | DSTPORT | DSTIP |  USERID  | NULL |
+	+----+----+---------+-------+----------+------+
+	| 1  | 1  |    2    |   4   | Variable |  1   |
+	+----+----+---------+-------+----------+------+
+*/
+type Request4 struct {
+	Cmd    uint8
+	Addr   *Addr
+	UserID string
+}
+
+// NewRequest4 creates a SOCKS4 request, it's a SOCKS4a one if addr is a
+// domain
+func NewRequest4(cmd uint8, addr *Addr, userID string) *Request4 {
+	return &Request4{
+		Cmd:    cmd,
+		Addr:   addr,
+		UserID: userID,
+	}
+}
+
+// ReadRequest4 reads a SOCKS4 or SOCKS4a request from the stream
+func ReadRequest4(r io.Reader) (*Request4, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != Version4 {
+		return nil, ErrBadVersion
+	}
+
+	request := &Request4{
+		Cmd: b[1],
+	}
+	userID, err := readString4(r)
+	if err != nil {
+		return nil, err
+	}
+	request.UserID = userID
+
+	port := binary.BigEndian.Uint16(b[2:4])
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		domain, err := readString4(r)
+		if err != nil {
+			return nil, err
+		}
+		if domain == "" {
+			return nil, ErrBadFormat
+		}
+		request.Addr = &Addr{Type: AddrDomain, Host: domain, Port: port}
+	} else {
+		request.Addr = &Addr{Type: AddrIPv4, Host: net.IP(b[4:8]).String(), Port: port}
+	}
+
+	return request, nil
+}
+
+// readString4 reads a NULL-terminated string of at most 255 bytes
+func readString4(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == 255 {
+			return "", ErrBadFormat
+		}
+		s = append(s, b[0])
+	}
+}
+
+func (r *Request4) Write(w io.Writer) (err error) {
+	b := make([]byte, 8, 8+len(r.UserID)+1+len(r.Addr.Host)+1)
+	b[0] = Version4
+	b[1] = r.Cmd
+	binary.BigEndian.PutUint16(b[2:4], r.Addr.Port)
+
+	switch r.Addr.Type {
+	case AddrIPv4:
+		ip4 := net.ParseIP(r.Addr.Host).To4()
+		if ip4 == nil {
+			return ErrBadFormat
+		}
+		copy(b[4:8], ip4)
+	case AddrDomain:
+		b[7] = 1
+	default:
+		return ErrBadAddrType
+	}
+
+	b = append(append(b, r.UserID...), 0)
+	if r.Addr.Type == AddrDomain {
+		b = append(append(b, r.Addr.Host...), 0)
+	}
+	_, err = w.Write(b)
+	return
+}
+
+func (r *Request4) String() string {
+	return fmt.Sprintf("4 %d %s %s", r.Cmd, r.Addr.String(), r.UserID)
+}
+
+/*
+Reply4 is a SOCKS4 reply, VN is 0
+
+	+----+----+---------+-------+
+	| VN | CD | DSTPORT | DSTIP |
+	+----+----+---------+-------+
+	| 1  | 1  |    2    |   4   |
+	+----+----+---------+-------+
+*/
+type Reply4 struct {
+	Rep  uint8
+	Addr *Addr
+}
+
+// NewReply4 creates a SOCKS4 reply, the address is zero unless it's IPv4
+func NewReply4(rep uint8, addr *Addr) *Reply4 {
+	return &Reply4{
+		Rep:  rep,
+		Addr: addr,
+	}
+}
+
+// ReadReply4 reads a SOCKS4 reply from the stream
+func ReadReply4(r io.Reader) (*Reply4, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if b[0] != 0 {
+		return nil, ErrBadVersion
+	}
+
+	return &Reply4{
+		Rep: b[1],
+		Addr: &Addr{
+			Type: AddrIPv4,
+			Host: net.IP(b[4:8]).String(),
+			Port: binary.BigEndian.Uint16(b[2:4]),
+		},
+	}, nil
+}
+
+func (r *Reply4) Write(w io.Writer) (err error) {
+	b := make([]byte, 8)
+	b[1] = r.Rep
+	if r.Addr != nil {
+		if ip4 := net.ParseIP(r.Addr.Host).To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(b[2:4], r.Addr.Port)
+			copy(b[4:8], ip4)
+		}
+	}
+	_, err = w.Write(b)
+	return
+}
+
+func (r *Reply4) String() string {
+	addr := r.Addr
+	if addr == nil {
+		addr = &Addr{}
+	}
+	return fmt.Sprintf("0 %d %s", r.Rep, addr.String())
+}
@@ -35,6 +35,8 @@ const (
 	CmdBind
 	CmdUDP
 	CmdUDPOverTCP
+	CmdMux
+	CmdReverse
 )
 
 // Address types
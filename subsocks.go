@@ -6,4 +6,7 @@ var Version string = "dev"
 var needsTLS = map[string]bool{
 	"https": true,
 	"wss":   true,
+	"h2":    true,
+	"quic":  true,
+	"tls":   true,
 }
@@ -0,0 +1,221 @@
+// Package trie implements prefix trees of domains and IPs, which map
+// addresses to values. Zero means no value.
+package trie
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Tree holds values of IPs, CIDRs and domains
+type Tree struct {
+	Domains *DomainNode
+	IPv4    *IPNode
+	IPv6    *IPNode
+}
+
+// New creates an empty tree
+func New() *Tree {
+	return &Tree{
+		Domains: NewDomainNode(),
+		IPv4:    new(IPNode),
+		IPv6:    new(IPNode),
+	}
+}
+
+// Set sets the value of addr, which is an IP, a CIDR or a domain. A domain
+// starting with "*." matches itself and all its subdomains.
+func (t *Tree) Set(addr string, v int) error {
+	if ip := net.ParseIP(addr); ip != nil {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			t.IPv4.Set(ipv4, 32, v)
+		} else {
+			t.IPv6.Set(ip.To16(), 128, v)
+		}
+	} else if _, cidr, err := net.ParseCIDR(addr); err == nil {
+		ones, _ := cidr.Mask.Size()
+		if ipv4 := cidr.IP.To4(); ipv4 != nil {
+			t.IPv4.Set(ipv4, ones, v)
+		} else {
+			t.IPv6.Set(cidr.IP.To16(), ones, v)
+		}
+	} else {
+		return t.Domains.Set(addr, v)
+	}
+	return nil
+}
+
+// MatchIP returns the value of the narrowest CIDR containing ip
+func (t *Tree) MatchIP(ip net.IP) int {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return t.IPv4.Match(ipv4)
+	}
+	return t.IPv6.Match(ip.To16())
+}
+
+// DomainNode is a node of labels, children are keyed by the labels before
+type DomainNode struct {
+	Rule     int
+	Wild     bool
+	Children map[string]*DomainNode
+}
+
+// NewDomainNode creates an empty node
+func NewDomainNode() *DomainNode {
+	return &DomainNode{Children: make(map[string]*DomainNode)}
+}
+
+// Set sets the value of the domain under p
+func (p *DomainNode) Set(domain string, v int) error {
+	if i := strings.IndexByte(domain, '*'); i != 0 && i != -1 ||
+		strings.Count(domain, "*") > 1 {
+		return fmt.Errorf("Domain %q contains illegal wildcards", domain)
+	}
+
+	parts := strings.Split(domain, ".")
+
+	for i := len(parts) - 1; i > 0; i-- {
+		part := parts[i]
+		if p.Children[part] == nil {
+			p.Children[part] = NewDomainNode()
+		}
+		p = p.Children[part]
+	}
+
+	if part := parts[0]; part == "*" {
+		p.Rule = v
+		p.Wild = true
+	} else {
+		if p.Children[part] == nil {
+			p.Children[part] = NewDomainNode()
+		}
+		p.Children[part].Rule = v
+	}
+
+	return nil
+}
+
+// Match returns the value of the domain, or of the nearest wildcard
+// containing it
+func (p *DomainNode) Match(domain string) (v int) {
+	parts := strings.Split(domain, ".")
+	for i := len(parts) - 1; i >= 0; i-- {
+		p = p.Children[parts[i]]
+		if p == nil {
+			break
+		}
+
+		if p.Rule != 0 && (p.Wild || i == 0) {
+			v = p.Rule
+		}
+	}
+	return
+}
+
+// IPNode is a node of bits, the root holds the value of all IPs
+type IPNode struct {
+	Rule     int
+	Bits     []byte
+	Children [2]*IPNode
+}
+
+// Set sets the value of the first length bits of ip under root
+func (root *IPNode) Set(ip []byte, length int, v int) {
+	if length == 0 {
+		root.Rule = v
+		return
+	}
+
+	var p, pp *IPNode
+	p = root
+	j := 0
+	for i := 0; i < length; i++ {
+		b := (ip[i/8] >> (8 - i%8 - 1)) & 1
+
+		if j >= len(p.Bits) {
+			j = 0
+			pp = p
+			p = p.Children[b]
+		}
+
+		var pnode, node *IPNode
+		if p == nil {
+			pnode = pp
+		} else if p.Bits[j] != b {
+			// p: |------+---------|
+			//           ^ j
+			//    |--np--|----p----|
+
+			np := new(IPNode)
+			np.Bits = make([]byte, j)
+			copy(np.Bits, p.Bits[:j])
+
+			pp.Children[np.Bits[0]] = np
+
+			copy(p.Bits, p.Bits[j:])
+			p.Bits = p.Bits[:len(p.Bits)-j]
+
+			np.Children[p.Bits[0]] = p
+			pnode = np
+		} else if i == length-1 {
+			if j == len(p.Bits)-1 {
+				node = p
+			} else {
+				np := new(IPNode)
+				np.Bits = make([]byte, j+1)
+				copy(np.Bits, p.Bits[:j+1])
+
+				pp.Children[np.Bits[0]] = np
+				node = np
+
+				copy(p.Bits, p.Bits[j+1:])
+				p.Bits = p.Bits[:len(p.Bits)-j-1]
+
+				np.Children[p.Bits[0]] = p
+			}
+		}
+
+		if pnode != nil {
+			node = new(IPNode)
+			node.Bits = make([]byte, length-i)
+			for k := i; k < length; k++ {
+				node.Bits[k-i] = (ip[k/8] >> (8 - k%8 - 1)) & 1
+			}
+			pnode.Children[node.Bits[0]] = node
+		}
+
+		if node != nil {
+			node.Rule = v
+			break
+		}
+
+		j++
+	}
+}
+
+// Match returns the value of the longest prefix of ip under root
+func (root *IPNode) Match(ip []byte) (v int) {
+	v = root.Rule
+	p := root
+	j := 0
+	for i := 0; i < len(ip)*8; i++ {
+		b := (ip[i/8] >> (8 - i%8 - 1)) & 1
+
+		if j >= len(p.Bits) {
+			j = 0
+			p = p.Children[b]
+		}
+
+		if p == nil || p.Bits[j] != b {
+			break
+		}
+
+		if j == len(p.Bits)-1 && p.Rule != 0 {
+			v = p.Rule
+		}
+
+		j++
+	}
+	return
+}
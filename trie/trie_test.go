@@ -0,0 +1,57 @@
+package trie
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	tree := New()
+	for addr, v := range map[string]int{
+		"*.example.com":   1,
+		"www.example.com": 2,
+		"10.0.0.0/8":      3,
+		"10.1.2.3":        4,
+		"0.0.0.0/0":       5,
+		"2001:db8::/32":   6,
+	} {
+		if err := tree.Set(addr, v); err != nil {
+			t.Fatalf("Set %s failed: %s", addr, err)
+		}
+	}
+
+	for domain, want := range map[string]int{
+		"example.com":       1,
+		"a.b.example.com":   1,
+		"www.example.com":   2,
+		"a.www.example.com": 1,
+		"example.org":       0,
+	} {
+		if v := tree.Domains.Match(domain); v != want {
+			t.Fatalf("Value of %s got %d, want %d", domain, v, want)
+		}
+	}
+
+	for ip, want := range map[string]int{
+		"10.2.3.4":        3,
+		"10.1.2.3":        4,
+		"8.8.8.8":         5,
+		"::ffff:10.1.2.3": 4,
+		"2001:db8::1":     6,
+		"2001:db9::1":     0,
+	} {
+		if v := tree.MatchIP(net.ParseIP(ip)); v != want {
+			t.Fatalf("Value of %s got %d, want %d", ip, v, want)
+		}
+	}
+}
+
+func TestTreeIllegal(t *testing.T) {
+	for _, domain := range []string{"www.*.com", "www*.google.com", "**"} {
+		err := New().Set(domain, 1)
+		if err == nil || !strings.Contains(err.Error(), "contains illegal wildcards") {
+			t.Fatalf("Error of %q got %v, want illegal wildcards", domain, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ListenAdmin listens on addr for the admin API. Anyone reaching the API can
+// close tunnels, so a token is required unless addr is a loopback address.
+func ListenAdmin(addr, token string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		if a, ok := listener.Addr().(*net.TCPAddr); !ok || !a.IP.IsLoopback() {
+			listener.Close()
+			return nil, fmt.Errorf("Admin API on %s is not loopback, 'admin_token' is required", listener.Addr())
+		}
+	}
+	return listener, nil
+}
+
+// RequireToken returns a handler serving requests with the bearer token by
+// h, others get 401. All requests are served if token is empty.
+func RequireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		prefix := "Bearer "
+		if !strings.HasPrefix(auth, prefix) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListenAdmin(t *testing.T) {
+	cases := []struct {
+		addr  string
+		token string
+		ok    bool
+	}{
+		{"127.0.0.1:0", "", true},
+		{"[::1]:0", "", true},
+		{":0", "", false},
+		{":0", "s3cret", true},
+	}
+
+	for _, c := range cases {
+		ln, err := ListenAdmin(c.addr, c.token)
+		if (err == nil) != c.ok {
+			t.Fatalf("Listen %s with token %q got %v, want ok %v", c.addr, c.token, err, c.ok)
+		}
+		if err == nil {
+			ln.Close()
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := RequireToken("s3cret", NewRegistry())
+	cases := []struct {
+		auth string
+		code int
+	}{
+		{"Bearer s3cret", http.StatusOK},
+		{"Bearer s3cre", http.StatusUnauthorized},
+		{"Basic czNjcmV0", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Fatalf("Status with %q got %d, want %d", c.auth, w.Code, c.code)
+		}
+	}
+}
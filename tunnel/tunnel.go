@@ -0,0 +1,171 @@
+// Package tunnel keeps track of live tunnels, so that they can be listed
+// and closed.
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound means there's no tunnel with the ID
+var ErrNotFound = errors.New("Tunnel not found")
+
+// Tunnel describes a live tunnel
+type Tunnel struct {
+	up   int64
+	down int64
+
+	ID          uint64
+	Command     string
+	User        string
+	Source      string
+	Destination string
+	Rule        string
+	Start       time.Time
+
+	closers []io.Closer
+}
+
+// AddUp adds n bytes transferred from the source to the destination
+func (t *Tunnel) AddUp(n int) {
+	atomic.AddInt64(&t.up, int64(n))
+}
+
+// AddDown adds n bytes transferred from the destination to the source
+func (t *Tunnel) AddDown(n int) {
+	atomic.AddInt64(&t.down, int64(n))
+}
+
+// Close closes connections of the tunnel
+func (t *Tunnel) Close() error {
+	var err error
+	for _, c := range t.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Info is a snapshot of a tunnel
+type Info struct {
+	ID          uint64    `json:"id"`
+	Command     string    `json:"command"`
+	User        string    `json:"user,omitempty"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Rule        string    `json:"rule,omitempty"`
+	Up          int64     `json:"up"`
+	Down        int64     `json:"down"`
+	Start       time.Time `json:"start"`
+	Age         string    `json:"age"`
+}
+
+// Info returns a snapshot of the tunnel
+func (t *Tunnel) Info() Info {
+	return Info{
+		ID:          t.ID,
+		Command:     t.Command,
+		User:        t.User,
+		Source:      t.Source,
+		Destination: t.Destination,
+		Rule:        t.Rule,
+		Up:          atomic.LoadInt64(&t.up),
+		Down:        atomic.LoadInt64(&t.down),
+		Start:       t.Start,
+		Age:         time.Since(t.Start).Round(time.Second).String(),
+	}
+}
+
+// Registry holds live tunnels
+type Registry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	tunnels map[uint64]*Tunnel
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{tunnels: make(map[uint64]*Tunnel)}
+}
+
+// Add assigns an ID to the tunnel and adds it to the registry, closers are
+// closed if the tunnel is closed by Close
+func (r *Registry) Add(t *Tunnel, closers ...io.Closer) {
+	t.Start = time.Now()
+	t.closers = closers
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	t.ID = r.nextID
+	r.tunnels[t.ID] = t
+}
+
+// Remove removes the tunnel from the registry
+func (r *Registry) Remove(t *Tunnel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tunnels, t.ID)
+}
+
+// Close closes the tunnel with the ID
+func (r *Registry) Close(id uint64) error {
+	r.mu.Lock()
+	t, ok := r.tunnels[id]
+	r.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return t.Close()
+}
+
+// List returns snapshots of all tunnels ordered by ID
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	list := make([]Info, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		list = append(list, t.Info())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// ServeHTTP lists tunnels by "GET /", and closes a tunnel by "DELETE /<id>"
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	if path == "" {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.List())
+		return
+	}
+
+	id, err := strconv.ParseUint(path, 10, 64)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Close(id); err == ErrNotFound {
+		http.NotFound(w, req)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	c1, c2 := net.Pipe()
+	t1 := &Tunnel{Command: "connect", Source: "a", Destination: "b"}
+	r.Add(t1, c1, c2)
+	t1.AddUp(10)
+	t1.AddDown(20)
+
+	t2 := &Tunnel{Command: "bind"}
+	r.Add(t2)
+
+	list := r.List()
+	if len(list) != 2 || list[0].ID != 1 || list[1].ID != 2 {
+		t.Fatalf("List got %+v, want tunnels 1 and 2", list)
+	}
+	if list[0].Up != 10 || list[0].Down != 20 {
+		t.Fatalf("Bytes got %d/%d, want 10/20", list[0].Up, list[0].Down)
+	}
+
+	if err := r.Close(t1.ID); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if _, err := c2.Write([]byte{0}); err == nil {
+		t.Fatalf("Connections of the closed tunnel should be closed")
+	}
+	if err := r.Close(100); err != ErrNotFound {
+		t.Fatalf("Close unknown tunnel got %v, want %v", err, ErrNotFound)
+	}
+
+	r.Remove(t1)
+	if list := r.List(); len(list) != 1 || list[0].ID != t2.ID {
+		t.Fatalf("List got %+v, want tunnel 2", list)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	c1, c2 := net.Pipe()
+	r.Add(&Tunnel{Command: "connect", User: "admin"}, c1, c2)
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/1", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/2", http.StatusNotFound},
+		{http.MethodDelete, "/abc", http.StatusNotFound},
+		{http.MethodDelete, "/1", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Fatalf("%s %s got %d, want %d", c.method, c.path, w.Code, c.code)
+		}
+
+		if c.method == http.MethodGet && c.code == http.StatusOK {
+			var list []Info
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatalf("Decode list failed: %s", err)
+			}
+			if len(list) != 1 || list[0].User != "admin" || list[0].Command != "connect" {
+				t.Fatalf("List got %+v", list)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// StreamConn is a net.Conn made of a reader and a writer, such as bodies of
+// an HTTP/2 stream. A write that passes its deadline closes the conn since
+// the writer can't be interrupted.
+type StreamConn struct {
+	r          io.Reader
+	w          io.Writer
+	close      func() error
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	mu        sync.Mutex
+	deadline  time.Time
+	wdeadline time.Time
+	pending   chan streamRead // a read timed out and still going on
+	buf       []byte          // data read but not returned
+	err       error           // error of the read that buf comes from
+	once      sync.Once
+}
+
+type streamRead struct {
+	b   []byte
+	err error
+}
+
+// NewStreamConn returns a StreamConn, close is called once on Close
+func NewStreamConn(r io.Reader, w io.Writer, close func() error, localAddr, remoteAddr net.Addr) *StreamConn {
+	return &StreamConn{
+		r:          r,
+		w:          w,
+		close:      close,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+	}
+}
+
+func (c *StreamConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		var err error
+		if len(c.buf) == 0 {
+			err, c.err = c.err, nil
+		}
+		c.mu.Unlock()
+		return n, err
+	}
+	deadline, pending := c.deadline, c.pending
+	c.mu.Unlock()
+
+	if deadline.IsZero() && pending == nil {
+		return c.r.Read(b)
+	}
+
+	// the reader can't be interrupted, so it reads in another goroutine
+	// and the result is kept for the next read if it times out
+	if pending == nil {
+		pending = make(chan streamRead, 1)
+		p := make([]byte, len(b))
+		go func() {
+			n, err := c.r.Read(p)
+			pending <- streamRead{p[:n], err}
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-pending:
+		c.mu.Lock()
+		c.pending = nil
+		n := copy(b, r.b)
+		if n < len(r.b) {
+			c.buf, c.err = r.b[n:], r.err
+			r.err = nil
+		}
+		c.mu.Unlock()
+		return n, r.err
+	case <-timeout:
+		c.mu.Lock()
+		c.pending = pending
+		c.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *StreamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.wdeadline
+	c.mu.Unlock()
+
+	if deadline.IsZero() {
+		return c.w.Write(b)
+	}
+	if !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	// a blocked write only returns once the conn is closed
+	timer := time.AfterFunc(time.Until(deadline), func() { c.Close() })
+	n, err := c.w.Write(b)
+	if !timer.Stop() {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// Close calls the close function once
+func (c *StreamConn) Close() (err error) {
+	c.once.Do(func() {
+		err = c.close()
+	})
+	return
+}
+
+func (c *StreamConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *StreamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// SetDeadline sets the read and write deadlines
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *StreamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline, the conn is closed if a write
+// passes it
+func (c *StreamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+	return nil
+}
@@ -1,10 +1,14 @@
 package utils
 
 import (
+	"bufio"
 	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"io"
 	"log"
+	"net"
+	"os"
 	"strings"
 	"sync"
 
@@ -27,29 +31,89 @@ var (
 
 // Transport rw1 and rw2
 func Transport(rw1, rw2 io.ReadWriter) error {
-	errc := make(chan error, 1)
+	return TransportCount(rw1, rw2, nil, nil)
+}
+
+// TransportCount transports rw1 and rw2 like Transport, and reports bytes
+// copied from rw1 to rw2 to up, from rw2 to rw1 to down. up and down may be
+// nil. Once a side reaches EOF, the other side is half-closed if it
+// supports CloseWrite, and the other direction goes on until it ends too.
+func TransportCount(rw1, rw2 io.ReadWriter, up, down func(int)) error {
+	errc := make(chan error, 2)
 	go func() {
 		b := LPool.Get().([]byte)
 		defer LPool.Put(b)
 
-		_, err := io.CopyBuffer(rw1, rw2, b)
-		errc <- err
+		_, err := io.CopyBuffer(countWriter(rw1, down), rw2, b)
+		errc <- halfClose(rw1, err)
 	}()
 
 	go func() {
 		b := LPool.Get().([]byte)
 		defer LPool.Put(b)
 
-		_, err := io.CopyBuffer(rw2, rw1, b)
-		errc <- err
+		_, err := io.CopyBuffer(countWriter(rw2, up), rw1, b)
+		errc <- halfClose(rw2, err)
 	}()
 
-	if err := <-errc; err != nil && err != io.EOF {
-		return err
+	for i := 0; i < 2; i++ {
+		err := <-errc
+		if err == errHalfClosed {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return nil
 	}
 	return nil
 }
 
+// errHalfClosed means a direction of a transport ends and its destination
+// is half-closed
+var errHalfClosed = errors.New("Half closed")
+
+// halfClose half-closes w once copying to it ends with EOF, it returns
+// errHalfClosed if w is half-closed, otherwise err
+func halfClose(w io.Writer, err error) error {
+	if err != nil {
+		return err
+	}
+	for {
+		switch c := w.(type) {
+		case interface{ CloseWrite() error }:
+			if c.CloseWrite() != nil {
+				return nil
+			}
+			return errHalfClosed
+		case *userConn:
+			w = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+type counter struct {
+	io.Writer
+	count func(int)
+}
+
+func (c *counter) Write(b []byte) (int, error) {
+	n, err := c.Writer.Write(b)
+	c.count(n)
+	return n, err
+}
+
+// countWriter wraps w to report written bytes to count, it returns w
+// itself if count is nil so that io.ReaderFrom still works
+func countWriter(w io.Writer, count func(int)) io.Writer {
+	if count == nil {
+		return w
+	}
+	return &counter{w, count}
+}
+
 // StrEQ returns whether s1 and s2 are equal
 func StrEQ(s1, s2 string) bool {
 	return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1
@@ -88,18 +152,85 @@ func VerifyByHtpasswd(users string) func(string, string) bool {
 }
 
 func HttpBasicAuth(auth string, verify func(string, string) bool) bool {
+	_, ok := HttpBasicAuthUser(auth, verify)
+	return ok
+}
+
+// HttpBasicAuthUser verifies the HTTP basic authorization like
+// HttpBasicAuth, and returns the username if it's verified
+func HttpBasicAuthUser(auth string, verify func(string, string) bool) (string, bool) {
 	prefix := "Basic "
 	if !strings.HasPrefix(auth, prefix) {
-		return false
+		return "", false
 	}
 	auth = strings.Trim(auth[len(prefix):], " ")
 	dc, err := base64.StdEncoding.DecodeString(auth)
 	if err != nil {
-		return false
+		return "", false
 	}
 	groups := strings.Split(string(dc), ":")
 	if len(groups) != 2 {
-		return false
+		return "", false
+	}
+	if !verify(groups[0], groups[1]) {
+		return "", false
+	}
+	return groups[0], true
+}
+
+// SystemDNS returns the address of the first nameserver in
+// /etc/resolv.conf, or an empty string if there's none
+func SystemDNS() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
+
+type userConn struct {
+	net.Conn
+	user string
+}
+
+func (c *userConn) User() string {
+	return c.user
+}
+
+// WithUser attaches the authorized user to conn
+func WithUser(conn net.Conn, user string) net.Conn {
+	return &userConn{conn, user}
+}
+
+// UserOf returns the authorized user of conn, connections that record
+// their users have a User method
+func UserOf(conn net.Conn) string {
+	if c, ok := conn.(interface{ User() string }); ok {
+		return c.User()
+	}
+	return ""
+}
+
+// DatagramsOf returns the connection of UDP datagrams that the transport of
+// conn sends apart, nil if it has none
+func DatagramsOf(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case interface{ Datagrams() net.Conn }:
+			return c.Datagrams()
+		case *userConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
 	}
-	return verify(groups[0], groups[1])
 }